@@ -0,0 +1,247 @@
+package instana
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	agentRequestsURL = "/com.instana.plugin.golang/requests."
+	agentResponseURL = "/com.instana.plugin.golang/response."
+
+	DefaultAgentRequestsInterval = 1 * time.Second
+
+	// agentRequestsUnsupportedBackoff is how long the poller waits before
+	// asking an agent without the requests endpoint again
+	agentRequestsUnsupportedBackoff = 5 * time.Minute
+)
+
+// Built-in agent actions
+const (
+	// AgentActionGoroutines returns a dump of the stacks of all goroutines
+	AgentActionGoroutines = "goroutines"
+	// AgentActionLogLevel sets the log level of the sensor to the "level"
+	// argument, one of error, warn, info or debug
+	AgentActionLogLevel = "log-level"
+)
+
+// AgentRequest is an action the agent asks the sensor to run.
+type AgentRequest struct {
+	MessageID string                 `json:"messageId"`
+	Action    string                 `json:"action"`
+	Args      map[string]interface{} `json:"args"`
+}
+
+// AgentActionHandler runs an action requested by the agent. The result is
+// sent back to the agent as JSON.
+type AgentActionHandler func(args map[string]interface{}) (interface{}, error)
+
+type agentActionResponseS struct {
+	MessageID string      `json:"messageId"`
+	Data      interface{} `json:"data,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type agentActionsS struct {
+	sync.RWMutex
+	handlers map[string]AgentActionHandler
+}
+
+var agentActions = &agentActionsS{handlers: map[string]AgentActionHandler{
+	AgentActionGoroutines: goroutinesAction,
+	AgentActionLogLevel:   logLevelAction}}
+
+// RegisterAgentAction makes the sensor run handler when the agent
+// requests action. A handler registered for a built-in action replaces
+// it.
+func RegisterAgentAction(action string, handler AgentActionHandler) {
+	agentActions.register(action, handler)
+}
+
+func (r *agentActionsS) register(action string, handler AgentActionHandler) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.handlers[action] = handler
+}
+
+func (r *agentActionsS) get(action string) (AgentActionHandler, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	handler, ok := r.handlers[action]
+
+	return handler, ok
+}
+
+// actionPollerS fetches the requests the agent queued for the sensor once
+// it is ready, runs them and posts the responses back.
+type actionPollerS struct {
+	sensor  *sensorS
+	actions *agentActionsS
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	// closed once polling ended
+	done chan struct{}
+
+	// set while the agent answers that it does not support actions
+	unsupportedUntil time.Time
+}
+
+func (r *actionPollerS) init() {
+	r.stopCh = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+
+		for {
+			timer := r.sensor.getClock().NewTimer(r.sensor.options.AgentRequestsInterval)
+			select {
+			case <-timer.C():
+				r.poll()
+			case <-r.stopCh:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// stop ends polling and waits for a poll in progress to finish.
+func (r *actionPollerS) stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopCh)
+	})
+	<-r.done
+}
+
+// poll runs the pending requests of the agent.
+func (r *actionPollerS) poll() {
+	agent := r.sensor.agent
+	if agent.agentless || !agent.canSend() {
+		return
+	}
+
+	now := r.sensor.getClock().Now()
+	if now.Before(r.unsupportedUntil) {
+		return
+	}
+
+	requests, err := r.fetch()
+	if e, ok := err.(*agentResponseError); ok && e.code == http.StatusNotFound {
+		if r.unsupportedUntil.IsZero() {
+			log.debug("agent does not support actions, asking again every", agentRequestsUnsupportedBackoff)
+		}
+		r.unsupportedUntil = now.Add(agentRequestsUnsupportedBackoff)
+		return
+	}
+	r.unsupportedUntil = time.Time{}
+
+	if err != nil {
+		log.info("cannot fetch agent requests", err)
+		return
+	}
+
+	for _, req := range requests {
+		resp := r.run(req)
+		if _, err := agent.request(agent.makeURL(agentResponseURL), "POST", resp); err != nil {
+			log.info("cannot send the response to agent request", req.MessageID, err)
+		}
+	}
+}
+
+// fetch returns the requests the agent queued. A 404 is returned as is,
+// without logging it, as agents without actions support answer every poll
+// with it.
+func (r *actionPollerS) fetch() ([]AgentRequest, error) {
+	agent := r.sensor.agent
+	resp, err := agent.do(agent.makeURL(agentRequestsURL), "GET", nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var requests []AgentRequest
+	if err := json.NewDecoder(resp.Body).Decode(&requests); err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+func (r *actionPollerS) run(req AgentRequest) (resp *agentActionResponseS) {
+	log.debug("running agent action", req.Action, req.MessageID)
+
+	resp = &agentActionResponseS{MessageID: req.MessageID}
+
+	handler, ok := r.actions.get(req.Action)
+	if !ok {
+		resp.Error = "unknown action " + req.Action
+		return resp
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			resp.Data = nil
+			resp.Error = fmt.Sprint("action panicked: ", err)
+		}
+	}()
+
+	data, err := handler(req.Args)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+
+	resp.Data = data
+
+	return resp
+}
+
+func goroutinesAction(map[string]interface{}) (interface{}, error) {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 2); err != nil {
+		return nil, err
+	}
+
+	return buf.String(), nil
+}
+
+var logLevels = map[string]int{
+	"error": Error,
+	"warn":  Warn,
+	"info":  Info,
+	"debug": Debug}
+
+func logLevelAction(args map[string]interface{}) (interface{}, error) {
+	name, _ := args["level"].(string)
+	level, ok := logLevels[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("invalid log level %q", name)
+	}
+
+	log.setLevel(level)
+	log.info("log level set to", name, "by the agent")
+
+	return map[string]string{"level": strings.ToLower(name)}, nil
+}
+
+func (r *sensorS) initActionPoller() *actionPollerS {
+
+	log.debug("initializing agent action poller")
+
+	ret := new(actionPollerS)
+	ret.sensor = r
+	ret.actions = agentActions
+	ret.init()
+
+	return ret
+}
@@ -0,0 +1,209 @@
+package instana
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newActionsAgentServer answers the requests polls of the sensor with
+// requests and records the responses.
+func newActionsAgentServer(requests string, polls chan<- struct{}) (*httptest.Server, func() []agentActionResponseS) {
+	var mu sync.Mutex
+	var responses []agentActionResponseS
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case agentRequestsURL + "42":
+			w.Write([]byte(requests))
+			if polls != nil {
+				polls <- struct{}{}
+			}
+		case agentResponseURL + "42":
+			var resp agentActionResponseS
+			json.NewDecoder(req.Body).Decode(&resp)
+
+			mu.Lock()
+			defer mu.Unlock()
+			responses = append(responses, resp)
+		}
+	}))
+
+	return srv, func() []agentActionResponseS {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return responses
+	}
+}
+
+func TestActionPollerRunsRequests(t *testing.T) {
+	srv, responses := newActionsAgentServer(`[
+		{"messageId": "1", "action": "goroutines"},
+		{"messageId": "2", "action": "echo", "args": {"value": "hello"}},
+		{"messageId": "3", "action": "fail"},
+		{"messageId": "4", "action": "panic"},
+		{"messageId": "5", "action": "heap-profile"}
+	]`, nil)
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{})
+	useTestServer(t, agent, srv)
+
+	actions := &agentActionsS{handlers: map[string]AgentActionHandler{
+		AgentActionGoroutines: goroutinesAction}}
+	actions.register("echo", func(args map[string]interface{}) (interface{}, error) {
+		return args["value"], nil
+	})
+	actions.register("fail", func(map[string]interface{}) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	actions.register("panic", func(map[string]interface{}) (interface{}, error) {
+		panic("oops")
+	})
+
+	poller := &actionPollerS{sensor: agent.sensor, actions: actions}
+	poller.poll()
+
+	resps := responses()
+	if !assert.Len(t, resps, 5) {
+		return
+	}
+
+	assert.Equal(t, "1", resps[0].MessageID)
+	assert.Contains(t, resps[0].Data, "goroutine ")
+	assert.Equal(t, "hello", resps[1].Data)
+	assert.Equal(t, "failed", resps[2].Error)
+	assert.Equal(t, "action panicked: oops", resps[3].Error)
+	assert.Equal(t, "unknown action heap-profile", resps[4].Error)
+}
+
+func TestActionPollerOnlyWhenReady(t *testing.T) {
+	polls := make(chan struct{}, 10)
+	srv, _ := newActionsAgentServer(`[]`, polls)
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{AgentRequestsInterval: 10 * time.Second})
+	useTestServer(t, agent, srv)
+	agent.fsm.stop()
+	agent.state.set(AgentAnnounced)
+
+	clock := newFakeClock()
+	agent.sensor.clock = clock
+
+	poller := &actionPollerS{sensor: agent.sensor, actions: agentActions}
+	poller.init()
+
+	clock.waitTimers(t, 1)
+	clock.Advance(10 * time.Second)
+	clock.waitTimers(t, 1)
+	assert.Len(t, polls, 0, "The agent should not be polled before it is ready")
+
+	agent.state.set(AgentReady)
+	clock.Advance(10 * time.Second)
+
+	select {
+	case <-polls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The agent was not polled once ready")
+	}
+}
+
+func TestActionPollerBacksOffWithoutActionsSupport(t *testing.T) {
+	var polls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&polls, 1)
+		http.NotFound(w, req)
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{})
+	useTestServer(t, agent, srv)
+
+	clock := newFakeClock()
+	agent.sensor.clock = clock
+
+	poller := &actionPollerS{sensor: agent.sensor, actions: agentActions}
+	poller.poll()
+	poller.poll()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&polls), "An agent without actions support should not be polled every interval")
+
+	clock.Advance(agentRequestsUnsupportedBackoff)
+	poller.poll()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&polls), "The agent should be asked again after a while")
+}
+
+func TestRecorderStopStopsSensor(t *testing.T) {
+	var polls, metrics int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasPrefix(req.URL.Path, agentRequestsURL):
+			atomic.AddInt32(&polls, 1)
+			w.Write([]byte(`[]`))
+		case strings.HasPrefix(req.URL.Path, agentDataURL):
+			atomic.AddInt32(&metrics, 1)
+		}
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{AgentRequestsInterval: 10 * time.Second, MetricsInterval: 10 * time.Second})
+	useTestServer(t, agent, srv)
+
+	clock := newFakeClock()
+	agent.sensor.clock = clock
+
+	agent.sensor.poller = agent.sensor.initActionPoller()
+	agent.sensor.meter = agent.sensor.initMeter()
+	recorder := &Recorder{sensor: agent.sensor}
+	recorder.init()
+	clock.waitTimers(t, 3)
+
+	stopped := make(chan struct{})
+	go func() {
+		recorder.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The sensor did not stop")
+	}
+
+	clock.Advance(10 * time.Second)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&polls), "The agent should not be polled once stopped")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&metrics), "Metrics should not be sent once stopped")
+}
+
+func TestLogLevelAction(t *testing.T) {
+	InitSensor(&Options{LogLevel: Error})
+
+	level := log.getLevel()
+	defer log.setLevel(level)
+
+	resp, err := logLevelAction(map[string]interface{}{"level": "WARN"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"level": "warn"}, resp)
+	assert.Equal(t, Warn, log.getLevel())
+
+	_, err = logLevelAction(map[string]interface{}{"level": "verbose"})
+	assert.Error(t, err)
+	_, err = logLevelAction(nil)
+	assert.Error(t, err)
+	assert.Equal(t, Warn, log.getLevel())
+}
+
+func TestGoroutinesAction(t *testing.T) {
+	dump, err := goroutinesAction(nil)
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(dump.(string), "TestGoroutinesAction"))
+}
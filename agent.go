@@ -2,13 +2,17 @@ package instana
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
-	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
-	"time"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -19,19 +23,26 @@ const (
 	agentDefaultHost  = "localhost"
 	agentDefaultPort  = 42699
 	agentHeader       = "Instana Agent"
+
+	// maxErrorBodySize is how much of an error response is kept
+	maxErrorBodySize = 512
 )
 
 type agentResponse struct {
-	Pid    uint32 `json:"pid"`
-	HostID string `json:"agentUuid"`
+	Pid              uint32              `json:"pid"`
+	HostID           string              `json:"agentUuid"`
+	Secrets          *agentSecretsConfig `json:"secrets"`
+	ExtraHTTPHeaders []string            `json:"extraHeaders"`
+	Tracing          *agentTracingConfig `json:"tracing"`
 }
 
 type discoveryS struct {
-	PID   int      `json:"pid"`
-	Name  string   `json:"name"`
-	Args  []string `json:"args"`
-	Fd    string   `json:"fd"`
-	Inode string   `json:"inode"`
+	PID         int      `json:"pid"`
+	Name        string   `json:"name"`
+	Args        []string `json:"args"`
+	Fd          string   `json:"fd"`
+	Inode       string   `json:"inode"`
+	ContainerID string   `json:"containerId,omitempty"`
 }
 
 type fromS struct {
@@ -39,22 +50,89 @@ type fromS struct {
 	HostID string `json:"h"`
 }
 
+// agentResponseError is returned when the agent answers with a status
+// code outside of the 2xx range.
+type agentResponseError struct {
+	code   int
+	status string
+	// body is the beginning of the response body
+	body string
+}
+
+func (e *agentResponseError) Error() string {
+	return e.status
+}
+
+// rejectsEncoding reports whether the agent refused a request because of
+// its Content-Encoding rather than because of the payload itself.
+func (e *agentResponseError) rejectsEncoding() bool {
+	if e.code != http.StatusBadRequest {
+		return false
+	}
+
+	body := strings.ToLower(e.body)
+
+	return strings.Contains(body, "encoding") || strings.Contains(body, "gzip")
+}
+
 type agentS struct {
 	sensor *sensorS
 	fsm    *fsmS
-	from   *fromS
-	host   string
 	client *http.Client
+
+	// set by the fsm, read when sending
+	mu   sync.RWMutex
+	from *fromS
+	host string
+
+	// set when reporting to the backend acceptor without a host agent
+	agentless bool
+
+	retryPolicy retryPolicyS
+	// consecutive sends that failed to reach the agent
+	connFailures int32
+	// set once the agent rejected a compressed payload
+	noCompression int32
+
+	state agentStateS
 }
 
 func (r *agentS) init() {
-	r.client = &http.Client{Timeout: 5 * time.Second}
-	r.fsm = r.initFsm()
+	r.client = newAgentClient(r.sensor.options)
+	r.retryPolicy = retryPolicyS{
+		initialBackoff: sendRetryInitialBackoff,
+		maxBackoff:     sendRetryMaxBackoff,
+		retries:        maximumSendRetries}
+
+	if r.sensor.options.EndpointURL != "" {
+		if r.sensor.options.AgentKey != "" {
+			r.initAgentless()
+			return
+		}
+
+		log.error("Ignoring the endpoint URL, agentless mode needs an agent key in INSTANA_AGENT_KEY")
+	}
+
 	r.setFrom(&fromS{})
+	r.initFsm()
 }
 
 func (r *agentS) makeURL(prefix string) string {
-	return r.makeHostURL(r.host, prefix)
+	if r.agentless {
+		return r.makeAcceptorURL(prefix)
+	}
+
+	return r.makeHostURL(r.getHost(), prefix)
+}
+
+// hostAddr returns the host and port of the agent the sensor talks to.
+func (r *agentS) hostAddr() string {
+	u, err := url.Parse(r.makeHostURL(r.getHost(), "/"))
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
 }
 
 func (r *agentS) makeHostURL(host string, prefix string) string {
@@ -76,13 +154,14 @@ func (r *agentS) makeHostURL(host string, prefix string) string {
 func (r *agentS) makeFullURL(host string, port int, prefix string) string {
 	var buffer bytes.Buffer
 
-	buffer.WriteString("http://")
+	buffer.WriteString(r.sensor.options.AgentScheme)
+	buffer.WriteString("://")
 	buffer.WriteString(host)
 	buffer.WriteString(":")
 	buffer.WriteString(strconv.Itoa(port))
 	buffer.WriteString(prefix)
-	if prefix[len(prefix)-1:] == "." && r.from.PID != "" {
-		buffer.WriteString(r.from.PID)
+	if from := r.getFrom(); prefix[len(prefix)-1:] == "." && from.PID != "" {
+		buffer.WriteString(from.PID)
 	}
 
 	return buffer.String()
@@ -109,40 +188,38 @@ func (r *agentS) fullRequestResponse(url string, method string, data interface{}
 	var ret string
 	var err error
 	var resp *http.Response
-	var req *http.Request
-	if data != nil {
+	if raw, ok := data.(json.RawMessage); ok {
+		// already serialized
+		j = raw
+	} else if data != nil {
 		j, err = json.Marshal(data)
 	}
 
 	if err == nil {
-		if j != nil {
-			req, err = http.NewRequest(method, url, bytes.NewBuffer(j))
-		} else {
-			req, err = http.NewRequest(method, url, nil)
+		compressed := r.shouldCompress(method, j)
+		resp, err = r.do(url, method, j, compressed)
+
+		if e, ok := err.(*agentResponseError); ok && compressed {
+			if e.code == http.StatusUnsupportedMediaType || e.rejectsEncoding() {
+				log.info("agent does not accept compressed payloads, falling back to plain JSON")
+				atomic.StoreInt32(&r.noCompression, 1)
+				resp, err = r.do(url, method, j, false)
+			}
 		}
 
 		if err == nil {
-			req.Header.Set("Content-Type", "application/json")
-			resp, err = r.client.Do(req)
-			if err == nil {
-				defer resp.Body.Close()
-
-				if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-					err = errors.New(resp.Status)
-				} else {
-
-					log.debug("agent response:", url, resp.Status)
-
-					if body != nil {
-						var b []byte
-						b, err = ioutil.ReadAll(resp.Body)
-						json.Unmarshal(b, body)
-					}
-
-					if header != "" {
-						ret = resp.Header.Get(header)
-					}
-				}
+			defer resp.Body.Close()
+
+			log.debug("agent response:", url, resp.Status)
+
+			if body != nil {
+				var b []byte
+				b, err = ioutil.ReadAll(resp.Body)
+				json.Unmarshal(b, body)
+			}
+
+			if header != "" {
+				ret = resp.Header.Get(header)
 			}
 		}
 	}
@@ -151,7 +228,7 @@ func (r *agentS) fullRequestResponse(url string, method string, data interface{}
 		// Ignore errors while in announced stated (before ready) as
 		// this is the time where the entity is registering in the Instana
 		// backend and it will return 404 until it's done.
-		if !r.sensor.agent.fsm.fsm.Is("announced") {
+		if r.agentless || r.state.get() != AgentAnnounced {
 			log.info(err, url)
 		}
 	}
@@ -159,15 +236,97 @@ func (r *agentS) fullRequestResponse(url string, method string, data interface{}
 	return ret, err
 }
 
+// shouldCompress reports whether a payload is sent gzip encoded. Only
+// data posted to the agent (traces, metrics and events) is compressed, and
+// only once it reaches the configured threshold.
+func (r *agentS) shouldCompress(method string, payload []byte) bool {
+	threshold := r.sensor.options.CompressionThreshold
+
+	return method == "POST" &&
+		threshold > 0 &&
+		len(payload) >= threshold &&
+		atomic.LoadInt32(&r.noCompression) == 0
+}
+
+// do sends a single request to the agent. Responses outside of the 2xx
+// range are returned as an *agentResponseError with the body closed.
+func (r *agentS) do(url string, method string, payload []byte, compressed bool) (*http.Response, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		if compressed {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write(payload)
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			reqBody = &buf
+		} else {
+			reqBody = bytes.NewReader(payload)
+		}
+	}
+
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if r.agentless {
+		r.setAcceptorHeaders(req)
+	}
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		resp.Body.Close()
+		return nil, &agentResponseError{code: resp.StatusCode, status: resp.Status, body: string(b)}
+	}
+
+	return resp, nil
+}
+
 func (r *agentS) setFrom(from *fromS) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	r.from = from
 }
 
+func (r *agentS) getFrom() *fromS {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.from
+}
+
 func (r *agentS) setHost(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	r.host = host
 }
 
+func (r *agentS) getHost() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.host
+}
+
 func (r *agentS) reset() {
+	if r.agentless {
+		// nothing to look up and announce again
+		return
+	}
+
 	r.fsm.reset()
 }
 
@@ -0,0 +1,210 @@
+package instana
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestAgent returns an agent that is ready to send data without
+// going through host lookup and announce. Once reset it does not find an
+// agent again unless opts.AgentDiscovery says otherwise.
+func newTestAgent(opts *Options) *agentS {
+	InitSensor(&Options{LogLevel: Debug})
+
+	s := &sensorS{}
+	s.setOptions(opts)
+	s.configureServiceName()
+	if len(s.options.AgentDiscovery) == 0 {
+		s.options.AgentDiscovery = []AgentDiscoverySource{DiscoverHosts()}
+	}
+
+	r := &agentS{sensor: s, client: newAgentClient(s.options)}
+	r.retryPolicy = retryPolicyS{initialBackoff: time.Millisecond, maxBackoff: 4 * time.Millisecond, retries: maximumSendRetries}
+	r.setFrom(&fromS{PID: "42", HostID: "host"})
+	r.fsm = &fsmS{agent: r}
+	r.fsm.start(AgentReady)
+	s.agent = r
+
+	return r
+}
+
+// useTestAgentDiscovery stops the fsm of a test agent and points agent
+// discovery at srv. Start a new fsm with initFsm to go through lookup and
+// announce from scratch.
+func useTestAgentDiscovery(t *testing.T, agent *agentS, srv *httptest.Server) {
+	useTestServer(t, agent, srv)
+	host, _, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	agent.sensor.options.AgentDiscovery = []AgentDiscoverySource{DiscoverHosts(host)}
+
+	agent.fsm.stop()
+	agent.state = agentStateS{}
+}
+
+// useTestServer points the agent at srv.
+func useTestServer(t *testing.T, agent *agentS, srv *httptest.Server) {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent.sensor.options.AgentPort, _ = strconv.Atoi(port)
+	agent.setHost(host)
+}
+
+type recordedRequest struct {
+	encoding string
+	body     []byte
+}
+
+func readRequest(t *testing.T, req *http.Request) recordedRequest {
+	var body io.Reader = req.Body
+	encoding := req.Header.Get("Content-Encoding")
+	if encoding == "gzip" {
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = zr
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	return recordedRequest{encoding: encoding, body: raw}
+}
+
+func TestAgentCompressedPayload(t *testing.T) {
+	var got []recordedRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = append(got, readRequest(t, req))
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{CompressionThreshold: 64})
+
+	small := map[string]string{"a": "b"}
+	large := map[string]string{"payload": string(make([]byte, 128))}
+
+	_, err := agent.request(srv.URL, "POST", small)
+	assert.NoError(t, err)
+	_, err = agent.request(srv.URL, "POST", large)
+	assert.NoError(t, err)
+	_, err = agent.request(srv.URL, "PUT", large)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 3, len(got))
+	assert.Equal(t, "", got[0].encoding, "Payloads below the threshold should not be compressed")
+	assert.Equal(t, "gzip", got[1].encoding, "Payloads above the threshold should be compressed")
+	assert.Equal(t, "", got[2].encoding, "Only posted data should be compressed")
+
+	var decoded map[string]string
+	assert.NoError(t, json.Unmarshal(got[1].body, &decoded))
+	assert.Equal(t, large, decoded)
+}
+
+func TestAgentCompressionDisabledByDefault(t *testing.T) {
+	var got []recordedRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = append(got, readRequest(t, req))
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{})
+
+	_, err := agent.request(srv.URL, "POST", map[string]string{"payload": string(make([]byte, 4096))})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, "", got[0].encoding)
+}
+
+func TestAgentCompressionFallback(t *testing.T) {
+	var got []recordedRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") != "" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		got = append(got, readRequest(t, req))
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{CompressionThreshold: 1})
+
+	_, err := agent.request(srv.URL, "POST", map[string]string{"a": "b"})
+	assert.NoError(t, err, "Rejected compressed payload should be resent uncompressed")
+	_, err = agent.request(srv.URL, "POST", map[string]string{"c": "d"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, len(got))
+	assert.Equal(t, int32(1), agent.noCompression, "Compression should stay disabled after a rejection")
+}
+
+func TestAgentCompressionFallbackOnEncodingError(t *testing.T) {
+	var got []recordedRequest
+	var rejected int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") != "" {
+			rejected++
+			http.Error(w, "unsupported content encoding gzip", http.StatusBadRequest)
+			return
+		}
+		got = append(got, readRequest(t, req))
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{CompressionThreshold: 1})
+
+	_, err := agent.request(srv.URL, "POST", map[string]string{"a": "b"})
+	assert.NoError(t, err, "Rejected compressed payload should be resent uncompressed")
+	_, err = agent.request(srv.URL, "POST", map[string]string{"c": "d"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, len(got))
+	assert.Equal(t, 1, rejected, "Later payloads should not be compressed")
+	assert.Equal(t, int32(1), agent.noCompression, "Compression should stay disabled after the encoding was rejected")
+}
+
+func TestAgentCompressionKeptOnBadPayload(t *testing.T) {
+	var got []recordedRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = append(got, readRequest(t, req))
+		http.Error(w, "invalid span", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{CompressionThreshold: 1})
+
+	_, err := agent.request(srv.URL, "POST", map[string]string{"a": "b"})
+	assert.Error(t, err)
+
+	if assert.Equal(t, 1, len(got), "A bad payload should not be resent") {
+		assert.Equal(t, "gzip", got[0].encoding)
+	}
+	assert.Equal(t, int32(0), agent.noCompression, "Compression should stay on after a bad payload")
+}
+
+func TestAgentHostAddr(t *testing.T) {
+	agent := newTestAgent(&Options{AgentPort: 4242})
+	agent.setHost("10.0.0.1")
+
+	assert.Equal(t, "10.0.0.1:4242", agent.hostAddr(), "The fd lookup should use the configured agent port")
+}
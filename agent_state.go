@@ -0,0 +1,191 @@
+package instana
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// AgentState is the state of the connection to the host agent.
+type AgentState string
+
+// Connection states, in the order the sensor goes through them. On
+// failure the sensor starts over with AgentInit.
+const (
+	// AgentNone is the state before the sensor is initialized
+	AgentNone AgentState = "none"
+	// AgentInit is the state while the agent host is looked up
+	AgentInit AgentState = "init"
+	// AgentUnannounced is the state while the sensor announces itself
+	AgentUnannounced AgentState = "unannounced"
+	// AgentAnnounced is the state while the connection is tested
+	AgentAnnounced AgentState = "announced"
+	// AgentReady is the state once spans, metrics and events are sent.
+	// Agentless sensors are always ready.
+	AgentReady AgentState = "ready"
+)
+
+// ErrSensorNotInitialized is returned when the connection state is queried
+// before the sensor is initialized.
+var ErrSensorNotInitialized = errors.New("instana: sensor is not initialized")
+
+// agentStateS tracks the connection state of an agent and notifies
+// listeners on transitions.
+type agentStateS struct {
+	sync.Mutex
+	current   AgentState
+	listeners []func(from, to AgentState)
+	// closed and replaced on every transition
+	changed chan struct{}
+
+	// transitions waiting for the listeners, delivered in order by the
+	// notify goroutine once woken up
+	pending []stateChangeS
+	wake    chan struct{}
+}
+
+type stateChangeS struct {
+	from, to  AgentState
+	listeners []func(from, to AgentState)
+}
+
+func (r *agentStateS) get() AgentState {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.current == "" {
+		return AgentNone
+	}
+
+	return r.current
+}
+
+// set moves to state to and queues the transition for the listeners, so
+// a slow listener never holds up the goroutine making the transition.
+func (r *agentStateS) set(to AgentState) {
+	r.Lock()
+	from := r.current
+	if from == "" {
+		from = AgentNone
+	}
+	if from == to {
+		r.Unlock()
+		return
+	}
+
+	r.current = to
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+	if len(r.listeners) > 0 {
+		r.pending = append(r.pending, stateChangeS{from: from, to: to, listeners: r.listeners})
+		select {
+		case r.wake <- struct{}{}:
+		default:
+			// the notify goroutine is already woken up
+		}
+	}
+	r.Unlock()
+
+	log.debug("agent connection state changed from", from, "to", to)
+}
+
+// onChange registers a listener. The listeners are called one transition
+// at a time, in order, from a goroutine of their own started along with
+// the first listener.
+func (r *agentStateS) onChange(fn func(from, to AgentState)) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.wake == nil {
+		r.wake = make(chan struct{}, 1)
+		go r.notify()
+	}
+
+	r.listeners = append(r.listeners, fn)
+}
+
+func (r *agentStateS) notify() {
+	for range r.wake {
+		r.Lock()
+		pending := r.pending
+		r.pending = nil
+		r.Unlock()
+
+		for _, c := range pending {
+			for _, fn := range c.listeners {
+				fn(c.from, c.to)
+			}
+		}
+	}
+}
+
+// waitReady blocks until the state is AgentReady or ctx is done.
+func (r *agentStateS) waitReady(ctx context.Context) error {
+	for {
+		r.Lock()
+		if r.current == AgentReady {
+			r.Unlock()
+			return nil
+		}
+		if r.changed == nil {
+			r.changed = make(chan struct{})
+		}
+		changed := r.changed
+		r.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func getAgent() *agentS {
+	if sensor == nil {
+		return nil
+	}
+
+	return sensor.agent
+}
+
+// AgentConnectionState returns the state of the sensor's connection to the
+// host agent.
+func AgentConnectionState() AgentState {
+	agent := getAgent()
+	if agent == nil {
+		return AgentNone
+	}
+
+	return agent.state.get()
+}
+
+// OnAgentStateChange registers fn to be called on every change of the
+// connection state. The listeners are called in order of the transitions
+// from a goroutine of their own, so a listener may see a transition after
+// the state moved on, and a listener blocking delays the ones after it but
+// not the sensor. Transitions before the registration are not replayed,
+// check AgentConnectionState afterwards for the current state.
+func OnAgentStateChange(fn func(from, to AgentState)) error {
+	agent := getAgent()
+	if agent == nil {
+		return ErrSensorNotInitialized
+	}
+
+	agent.state.onChange(fn)
+
+	return nil
+}
+
+// WaitReady blocks until the sensor is connected to the agent and ready to
+// send data, or ctx is done.
+func WaitReady(ctx context.Context) error {
+	agent := getAgent()
+	if agent == nil {
+		return ErrSensorNotInitialized
+	}
+
+	return agent.state.waitReady(ctx)
+}
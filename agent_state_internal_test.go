@@ -0,0 +1,141 @@
+package instana
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentStateTransitions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/":
+			w.Header().Set("Server", agentHeader)
+		case agentDiscoveryURL:
+			w.Write([]byte(`{"pid":4242,"agentUuid":"agent-id"}`))
+		}
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var transitions []string
+	onChange := func(from, to AgentState) {
+		mu.Lock()
+		defer mu.Unlock()
+		transitions = append(transitions, string(from)+"->"+string(to))
+	}
+
+	agent := newTestAgent(&Options{AgentRetryPeriod: time.Millisecond})
+	useTestAgentDiscovery(t, agent, srv)
+	agent.state.onChange(onChange)
+	agent.initFsm()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, agent.state.waitReady(ctx))
+	assert.Equal(t, AgentReady, agent.state.get())
+
+	// listeners are called from a goroutine of their own
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(transitions)
+		mu.Unlock()
+
+		if n >= 4 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{
+		"none->init",
+		"init->unannounced",
+		"unannounced->announced",
+		"announced->ready"}, transitions)
+}
+
+func TestAgentStateWaitReadyTimeout(t *testing.T) {
+	InitSensor(&Options{LogLevel: Debug})
+
+	var state agentStateS
+	state.set(AgentInit)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, state.waitReady(ctx))
+}
+
+func TestAgentStateWaitReadyWakesUp(t *testing.T) {
+	InitSensor(&Options{LogLevel: Debug})
+
+	var state agentStateS
+	done := make(chan error)
+	go func() {
+		done <- state.waitReady(context.Background())
+	}()
+
+	state.set(AgentInit)
+	state.set(AgentUnannounced)
+	state.set(AgentAnnounced)
+	state.set(AgentReady)
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitReady did not return once the agent was ready")
+	}
+}
+
+func TestAgentStateBlockingListener(t *testing.T) {
+	InitSensor(&Options{LogLevel: Debug})
+
+	var state agentStateS
+	release := make(chan struct{})
+	seen := make(chan AgentState, 10)
+	state.onChange(func(from, to AgentState) {
+		<-release
+		seen <- to
+	})
+
+	done := make(chan struct{})
+	go func() {
+		state.set(AgentInit)
+		state.set(AgentUnannounced)
+		state.set(AgentAnnounced)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("A blocking listener should not hold up transitions")
+	}
+	close(release)
+
+	var got []AgentState
+	for len(got) < 3 {
+		select {
+		case to := <-seen:
+			got = append(got, to)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Listener missed transitions, got %v", got)
+		}
+	}
+	assert.Equal(t, []AgentState{AgentInit, AgentUnannounced, AgentAnnounced}, got, "Transitions should be delivered in order")
+}
+
+func TestAgentlessAgentIsReady(t *testing.T) {
+	s := newAgentlessSensor("http://localhost:1")
+
+	assert.Equal(t, AgentReady, s.agent.state.get())
+	assert.NoError(t, s.agent.state.waitReady(context.Background()))
+}
@@ -0,0 +1,66 @@
+package instana
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Paths of the backend acceptor, relative to Options.EndpointURL
+const (
+	acceptorTracesPath  = "/traces"
+	acceptorMetricsPath = "/metrics"
+	acceptorEventsPath  = "/events"
+)
+
+// Headers identifying the reporting entity to the backend acceptor
+const (
+	acceptorKeyHeader  = "X-Instana-Key"
+	acceptorHostHeader = "X-Instana-Host"
+	acceptorTimeHeader = "X-Instana-Time"
+)
+
+// initAgentless sets the agent up to report straight to the backend
+// acceptor at Options.EndpointURL. There is no host agent to look up and
+// announce to, so the entity is identified by this process' PID and the
+// host name and the agent is ready right away.
+func (r *agentS) initAgentless() {
+	log.info("Reporting directly to", r.sensor.options.EndpointURL)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = agentDefaultHost
+	}
+
+	r.agentless = true
+	r.setFrom(&fromS{
+		PID:    strconv.Itoa(os.Getpid()),
+		HostID: hostname})
+	r.state.set(AgentReady)
+}
+
+// makeAcceptorURL maps an agent endpoint onto its backend acceptor
+// counterpart.
+func (r *agentS) makeAcceptorURL(prefix string) string {
+	endpoint := strings.TrimRight(r.sensor.options.EndpointURL, "/")
+
+	switch prefix {
+	case agentTracesURL:
+		return endpoint + acceptorTracesPath
+	case agentDataURL:
+		return endpoint + acceptorMetricsPath
+	case agentEventURL:
+		return endpoint + acceptorEventsPath
+	}
+
+	return endpoint + prefix
+}
+
+// setAcceptorHeaders authenticates a request to the backend acceptor.
+func (r *agentS) setAcceptorHeaders(req *http.Request) {
+	req.Header.Set(acceptorKeyHeader, r.sensor.options.AgentKey)
+	req.Header.Set(acceptorHostHeader, r.getFrom().HostID)
+	req.Header.Set(acceptorTimeHeader, strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
+}
@@ -0,0 +1,131 @@
+package instana
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type acceptorRequest struct {
+	path   string
+	header http.Header
+	body   json.RawMessage
+}
+
+type testAcceptor struct {
+	sync.Mutex
+	requests []acceptorRequest
+}
+
+func (r *testAcceptor) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body json.RawMessage
+	json.NewDecoder(req.Body).Decode(&body)
+
+	r.Lock()
+	defer r.Unlock()
+	r.requests = append(r.requests, acceptorRequest{path: req.URL.Path, header: req.Header, body: body})
+}
+
+func (r *testAcceptor) byPath(path string) []acceptorRequest {
+	r.Lock()
+	defer r.Unlock()
+
+	var ret []acceptorRequest
+	for _, req := range r.requests {
+		if req.path == path {
+			ret = append(ret, req)
+		}
+	}
+
+	return ret
+}
+
+func newAgentlessSensor(endpoint string) *sensorS {
+	InitSensor(&Options{LogLevel: Debug})
+
+	s := &sensorS{}
+	s.setOptions(&Options{Service: "sandbox", EndpointURL: endpoint + "/acceptor/", AgentKey: "secret-key"})
+	s.configureServiceName()
+	s.agent = s.initAgent()
+
+	return s
+}
+
+func TestAgentlessAgent(t *testing.T) {
+	acceptor := &testAcceptor{}
+	srv := httptest.NewServer(acceptor)
+	defer srv.Close()
+
+	s := newAgentlessSensor(srv.URL)
+
+	assert.True(t, s.agent.canSend(), "Agentless mode should be ready right away")
+	assert.Nil(t, s.agent.fsm, "Agentless mode should not look up a host agent")
+	assert.Equal(t, strconv.Itoa(os.Getpid()), s.agent.from.PID)
+	assert.Equal(t, srv.URL+"/acceptor/traces", s.agent.makeURL(agentTracesURL))
+	assert.Equal(t, srv.URL+"/acceptor/metrics", s.agent.makeURL(agentDataURL))
+	assert.Equal(t, srv.URL+"/acceptor/events", s.agent.makeURL(agentEventURL))
+
+	s.agent.reset()
+	assert.True(t, s.agent.canSend(), "Reset should not affect agentless mode")
+}
+
+func TestAgentlessNeedsAgentKey(t *testing.T) {
+	if key, ok := os.LookupEnv("INSTANA_AGENT_KEY"); ok {
+		os.Unsetenv("INSTANA_AGENT_KEY")
+		defer os.Setenv("INSTANA_AGENT_KEY", key)
+	}
+
+	InitSensor(&Options{LogLevel: Error})
+
+	s := &sensorS{}
+	s.setOptions(&Options{EndpointURL: "http://localhost/acceptor"})
+	s.agent = s.initAgent()
+	defer s.agent.fsm.stop()
+
+	assert.False(t, s.agent.agentless, "Agentless mode should not be used without an agent key")
+	assert.NotEqual(t, "http://localhost/acceptor/traces", s.agent.makeURL(agentTracesURL))
+}
+
+func TestAgentlessReporting(t *testing.T) {
+	acceptor := &testAcceptor{}
+	srv := httptest.NewServer(acceptor)
+	defer srv.Close()
+
+	s := newAgentlessSensor(srv.URL)
+
+	recorder := &Recorder{sensor: s}
+	recorder.init()
+	recorder.RecordSpan(newTestSpan("sandboxed"))
+	recorder.Stop()
+
+	meter := &meterS{sensor: s}
+	meter.send(&EntityData{PID: 1, Snapshot: meter.collectSnapshot(), Metrics: meter.collectMetrics()})
+
+	traces := acceptor.byPath("/acceptor/traces")
+	if assert.Equal(t, 1, len(traces)) {
+		assert.Equal(t, "secret-key", traces[0].header.Get(acceptorKeyHeader))
+		assert.Equal(t, s.agent.from.HostID, traces[0].header.Get(acceptorHostHeader))
+		assert.NotEmpty(t, traces[0].header.Get(acceptorTimeHeader))
+
+		var spans []jsonSpan
+		assert.NoError(t, json.Unmarshal(traces[0].body, &spans))
+		assert.Equal(t, "sandboxed", spans[0].Data.SDK.Name)
+		assert.Equal(t, "sandbox", spans[0].Data.Service)
+		assert.Equal(t, s.agent.from, spans[0].From, "Spans should carry the entity metadata")
+	}
+
+	metrics := acceptor.byPath("/acceptor/metrics")
+	if assert.Equal(t, 1, len(metrics)) {
+		assert.Equal(t, "secret-key", metrics[0].header.Get(acceptorKeyHeader))
+
+		var data EntityData
+		assert.NoError(t, json.Unmarshal(metrics[0].body, &data))
+		assert.Equal(t, "sandbox", data.Snapshot.Name)
+	}
+}
@@ -0,0 +1,360 @@
+// Package agenttest provides a fake Instana host agent for tests. It
+// answers the requests of the sensor the way an agent does, records every
+// payload for assertions and fails or slows down requests on demand.
+//
+// It does not depend on the sensor, so the sensor's own tests can use it
+// too:
+//
+//	agent := agenttest.New()
+//	defer agent.Close()
+//
+//	instana.InitSensor(&instana.Options{
+//		AgentHost: agent.Host(),
+//		AgentPort: agent.Port()})
+package agenttest
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths of the agent endpoints, followed by the PID of the announced
+// process where they end with a dot
+const (
+	DiscoveryPath = "/com.instana.plugin.golang.discovery"
+	DataPath      = "/com.instana.plugin.golang."
+	TracesPath    = "/com.instana.plugin.golang/traces."
+	EventsPath    = "/com.instana.plugin.generic.event"
+	RequestsPath  = "/com.instana.plugin.golang/requests."
+	ResponsePath  = "/com.instana.plugin.golang/response."
+)
+
+// Header is the Server header the agent answers its probe with
+const Header = "Instana Agent"
+
+// Endpoint is a kind of request the sensor sends to the agent.
+type Endpoint string
+
+// Endpoints failures and delays can be injected into
+const (
+	Probe     Endpoint = "probe"
+	Announce  Endpoint = "announce"
+	Ready     Endpoint = "ready"
+	Metrics   Endpoint = "metrics"
+	Traces    Endpoint = "traces"
+	Events    Endpoint = "events"
+	Requests  Endpoint = "requests"
+	Responses Endpoint = "responses"
+)
+
+// Request is a request the agent received.
+type Request struct {
+	Endpoint Endpoint
+	Method   string
+	Path     string
+	// Status is the status code the agent answered with
+	Status int
+}
+
+type failureS struct {
+	status int
+	times  int
+}
+
+// Agent is a fake host agent listening on a local port.
+type Agent struct {
+	// Server is the underlying test server
+	Server *httptest.Server
+	// PID and HostID are assigned to the process on announce, change them
+	// before the sensor announces itself
+	PID    int
+	HostID string
+
+	mu       sync.Mutex
+	requests []Request
+	payloads map[Endpoint][]json.RawMessage
+	failures map[Endpoint]*failureS
+	delays   map[Endpoint]time.Duration
+	announce map[string]interface{}
+	pending  []json.RawMessage
+}
+
+// New starts a fake agent. Close it once done.
+func New() *Agent {
+	ret := &Agent{
+		PID:      4242,
+		HostID:   "agenttest",
+		payloads: make(map[Endpoint][]json.RawMessage),
+		failures: make(map[Endpoint]*failureS),
+		delays:   make(map[Endpoint]time.Duration)}
+	ret.Server = httptest.NewServer(http.HandlerFunc(ret.serveHTTP))
+
+	return ret
+}
+
+// Close shuts the agent down.
+func (r *Agent) Close() {
+	r.Server.Close()
+}
+
+// Host returns the host the agent listens on.
+func (r *Agent) Host() string {
+	host, _, _ := net.SplitHostPort(r.Server.Listener.Addr().String())
+
+	return host
+}
+
+// Port returns the port the agent listens on.
+func (r *Agent) Port() int {
+	_, port, _ := net.SplitHostPort(r.Server.Listener.Addr().String())
+	ret, _ := strconv.Atoi(port)
+
+	return ret
+}
+
+// Fail makes the next times requests to endpoint fail with status, all
+// of them if times is negative. A later call replaces the failure, a zero
+// times removes it.
+func (r *Agent) Fail(endpoint Endpoint, status int, times int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if times == 0 {
+		delete(r.failures, endpoint)
+		return
+	}
+
+	r.failures[endpoint] = &failureS{status: status, times: times}
+}
+
+// Delay makes the agent wait d before answering requests to endpoint.
+func (r *Agent) Delay(endpoint Endpoint, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.delays[endpoint] = d
+}
+
+// AnnounceConfig adds fields, such as the secrets or tracing
+// configuration, to the answer to announces.
+func (r *Agent) AnnounceConfig(config map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.announce = config
+}
+
+// QueueRequest queues an action for the sensor, handed out on its next
+// poll.
+func (r *Agent) QueueRequest(messageID, action string, args map[string]interface{}) {
+	b, _ := json.Marshal(map[string]interface{}{
+		"messageId": messageID,
+		"action":    action,
+		"args":      args})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending = append(r.pending, b)
+}
+
+// Requests returns the requests received so far.
+func (r *Agent) Requests() []Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Request(nil), r.requests...)
+}
+
+// Count returns the number of requests to endpoint received so far,
+// failed ones included.
+func (r *Agent) Count(endpoint Endpoint) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ret int
+	for _, req := range r.requests {
+		if req.Endpoint == endpoint {
+			ret++
+		}
+	}
+
+	return ret
+}
+
+// Announces returns the announce payloads accepted so far.
+func (r *Agent) Announces() []json.RawMessage {
+	return r.payloadsOf(Announce)
+}
+
+// Metrics returns the metrics payloads accepted so far.
+func (r *Agent) Metrics() []json.RawMessage {
+	return r.payloadsOf(Metrics)
+}
+
+// Spans returns the spans accepted so far, in the order they were
+// received.
+func (r *Agent) Spans() []json.RawMessage {
+	return r.payloadsOf(Traces)
+}
+
+// Events returns the events accepted so far.
+func (r *Agent) Events() []json.RawMessage {
+	return r.payloadsOf(Events)
+}
+
+// Responses returns the responses to queued requests accepted so far.
+func (r *Agent) Responses() []json.RawMessage {
+	return r.payloadsOf(Responses)
+}
+
+func (r *Agent) payloadsOf(endpoint Endpoint) []json.RawMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]json.RawMessage(nil), r.payloads[endpoint]...)
+}
+
+func endpointOf(req *http.Request) (Endpoint, bool) {
+	path := req.URL.Path
+
+	switch {
+	case path == "/":
+		return Probe, true
+	case path == DiscoveryPath:
+		return Announce, true
+	case path == EventsPath:
+		return Events, true
+	case strings.HasPrefix(path, TracesPath):
+		return Traces, true
+	case strings.HasPrefix(path, RequestsPath):
+		return Requests, true
+	case strings.HasPrefix(path, ResponsePath):
+		return Responses, true
+	case strings.HasPrefix(path, DataPath) && req.Method == "HEAD":
+		return Ready, true
+	case strings.HasPrefix(path, DataPath):
+		return Metrics, true
+	}
+
+	return "", false
+}
+
+// respond decides on the status of a request and records it.
+func (r *Agent) respond(endpoint Endpoint, req *http.Request) (int, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := http.StatusOK
+	if f := r.failures[endpoint]; f != nil {
+		status = f.status
+		if f.times > 0 {
+			f.times--
+			if f.times == 0 {
+				delete(r.failures, endpoint)
+			}
+		}
+	}
+
+	r.requests = append(r.requests, Request{
+		Endpoint: endpoint,
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		Status:   status})
+
+	return status, r.delays[endpoint]
+}
+
+func (r *Agent) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	endpoint, ok := endpointOf(req)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	status, delay := r.respond(endpoint, req)
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	var body io.Reader = req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+
+	switch endpoint {
+	case Probe:
+		w.Header().Set("Server", Header)
+	case Announce:
+		r.record(endpoint, body)
+		w.Write(r.announceResponse())
+	case Traces:
+		var spans []json.RawMessage
+		if err := json.NewDecoder(body).Decode(&spans); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		r.mu.Lock()
+		r.payloads[Traces] = append(r.payloads[Traces], spans...)
+		r.mu.Unlock()
+	case Metrics, Events, Responses:
+		r.record(endpoint, body)
+	case Requests:
+		r.mu.Lock()
+		pending := r.pending
+		r.pending = nil
+		r.mu.Unlock()
+
+		if pending == nil {
+			pending = []json.RawMessage{}
+		}
+		json.NewEncoder(w).Encode(pending)
+	}
+}
+
+func (r *Agent) record(endpoint Endpoint, body io.Reader) {
+	var payload json.RawMessage
+	if err := json.NewDecoder(body).Decode(&payload); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.payloads[endpoint] = append(r.payloads[endpoint], payload)
+}
+
+func (r *Agent) announceResponse() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp := map[string]interface{}{}
+	for k, v := range r.announce {
+		resp[k] = v
+	}
+	resp["pid"] = r.PID
+	resp["agentUuid"] = r.HostID
+
+	b, _ := json.Marshal(resp)
+
+	return b
+}
@@ -0,0 +1,67 @@
+package agenttest_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"testing"
+
+	"github.com/instana/golang-sensor/agenttest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentProbe(t *testing.T) {
+	agent := agenttest.New()
+	defer agent.Close()
+
+	resp, err := http.Get(agent.Server.URL + "/")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, agenttest.Header, resp.Header.Get("Server"))
+	}
+	assert.NotZero(t, agent.Port())
+	assert.Equal(t, "127.0.0.1", agent.Host())
+}
+
+func TestAgentFail(t *testing.T) {
+	agent := agenttest.New()
+	defer agent.Close()
+
+	agent.Fail(agenttest.Metrics, http.StatusServiceUnavailable, 2)
+
+	url := agent.Server.URL + agenttest.DataPath + "4242"
+	var statuses []int
+	for i := 0; i < 3; i++ {
+		resp, err := http.Post(url, "application/json", bytes.NewBufferString(`{"pid":4242}`))
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			statuses = append(statuses, resp.StatusCode)
+		}
+	}
+
+	assert.Equal(t, []int{503, 503, 200}, statuses)
+	assert.Len(t, agent.Metrics(), 1)
+	assert.Equal(t, 3, agent.Count(agenttest.Metrics))
+}
+
+func TestAgentCompressedSpans(t *testing.T) {
+	agent := agenttest.New()
+	defer agent.Close()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`[{"n":"a"},{"n":"b"}]`))
+	zw.Close()
+
+	req, _ := http.NewRequest("POST", agent.Server.URL+agenttest.TracesPath+"4242", &buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+
+	spans := agent.Spans()
+	if assert.Len(t, spans, 2) {
+		assert.JSONEq(t, `{"n":"b"}`, string(spans[1]))
+	}
+}
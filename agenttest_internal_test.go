@@ -0,0 +1,174 @@
+package instana
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/instana/golang-sensor/agenttest"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeAgentSensor returns a test agent that looks up and announces to
+// the fake agent from scratch once its fsm is started with initFsm.
+func newFakeAgentSensor(t *testing.T, fake *agenttest.Agent, opts *Options) *agentS {
+	if opts.AgentRetryPeriod == 0 {
+		opts.AgentRetryPeriod = time.Millisecond
+	}
+
+	agent := newTestAgent(opts)
+	useTestAgentDiscovery(t, agent, fake.Server)
+
+	return agent
+}
+
+func TestFsmAnnouncesToFakeAgent(t *testing.T) {
+	fake := agenttest.New()
+	defer fake.Close()
+
+	// the backend registers the process only a while after the announce
+	fake.Fail(agenttest.Ready, http.StatusNotFound, 1)
+
+	agent := newFakeAgentSensor(t, fake, &Options{})
+	agent.initFsm()
+	waitAgentReady(t, agent)
+
+	assert.Equal(t, "4242", agent.getFrom().PID)
+	assert.Equal(t, "agenttest", agent.getFrom().HostID)
+	assert.Equal(t, 2, fake.Count(agenttest.Ready))
+
+	announces := fake.Announces()
+	if assert.Len(t, announces, 1) {
+		var d discoveryS
+		assert.NoError(t, json.Unmarshal(announces[0], &d))
+		assert.NotZero(t, d.PID)
+		assert.NotEmpty(t, d.Name)
+	}
+}
+
+func TestFsmRetriesFailedAnnounces(t *testing.T) {
+	fake := agenttest.New()
+	defer fake.Close()
+
+	fake.Fail(agenttest.Announce, http.StatusNotFound, 1)
+
+	agent := newFakeAgentSensor(t, fake, &Options{AgentMaxRetries: 3})
+	agent.initFsm()
+	waitAgentReady(t, agent)
+
+	assert.Equal(t, 2, fake.Count(agenttest.Announce))
+	assert.Equal(t, 1, fake.Count(agenttest.Probe), "A retried announce should not look the agent up again")
+}
+
+func TestFsmStartsOverAfterServerErrors(t *testing.T) {
+	fake := agenttest.New()
+	defer fake.Close()
+
+	// two failed announces use up the retries
+	fake.Fail(agenttest.Announce, http.StatusInternalServerError, 2)
+
+	agent := newFakeAgentSensor(t, fake, &Options{AgentMaxRetries: 2})
+	agent.initFsm()
+	waitAgentReady(t, agent)
+
+	assert.Equal(t, 3, fake.Count(agenttest.Announce))
+	assert.Equal(t, 2, fake.Count(agenttest.Probe), "The agent should be looked up again")
+}
+
+func TestFsmSlowAgent(t *testing.T) {
+	fake := agenttest.New()
+	defer fake.Close()
+
+	fake.Delay(agenttest.Announce, 100*time.Millisecond)
+
+	agent := newFakeAgentSensor(t, fake, &Options{AgentTimeout: 20 * time.Millisecond})
+	agent.initFsm()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fake.Count(agenttest.Announce) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(t, agent.canSend(), "Announces timing out should keep the agent from getting ready")
+
+	fake.Delay(agenttest.Announce, 0)
+	waitAgentReady(t, agent)
+}
+
+func TestMeterSendsToFakeAgent(t *testing.T) {
+	fake := agenttest.New()
+	defer fake.Close()
+
+	agent := newTestAgent(&Options{})
+	useTestServer(t, agent, fake.Server)
+
+	meter := &meterS{sensor: agent.sensor, snapshotCountdown: 1}
+	meter.send(&EntityData{PID: 42, Snapshot: meter.collectSnapshot(), Metrics: meter.collectMetrics()})
+
+	// a failed post is retried
+	fake.Fail(agenttest.Metrics, http.StatusServiceUnavailable, 1)
+	meter.send(&EntityData{PID: 42, Metrics: meter.collectMetrics()})
+
+	metrics := fake.Metrics()
+	if assert.Len(t, metrics, 2) {
+		var d EntityData
+		assert.NoError(t, json.Unmarshal(metrics[0], &d))
+		assert.Equal(t, 42, d.PID)
+		assert.NotNil(t, d.Snapshot)
+		assert.NotNil(t, d.Metrics)
+
+		d = EntityData{}
+		assert.NoError(t, json.Unmarshal(metrics[1], &d))
+		assert.Nil(t, d.Snapshot)
+	}
+	assert.Equal(t, 3, fake.Count(agenttest.Metrics))
+}
+
+func TestRecorderSendsToFakeAgent(t *testing.T) {
+	fake := agenttest.New()
+	defer fake.Close()
+
+	agent := newTestAgent(&Options{CompressionThreshold: 1})
+	useTestServer(t, agent, fake.Server)
+
+	recorder := &Recorder{sensor: agent.sensor}
+	recorder.init()
+
+	fake.Fail(agenttest.Traces, http.StatusInternalServerError, 1)
+	for i := 0; i < 3; i++ {
+		recorder.RecordSpan(newTestSpan("sent"))
+	}
+	recorder.send()
+	recorder.Stop()
+
+	spans := fake.Spans()
+	if assert.Len(t, spans, 3) {
+		var span jsonSpan
+		assert.NoError(t, json.Unmarshal(spans[0], &span))
+		assert.Equal(t, "42", span.From.PID)
+	}
+	assert.Equal(t, 2, fake.Count(agenttest.Traces), "The failed post should be retried")
+}
+
+func TestActionPollerWithFakeAgent(t *testing.T) {
+	fake := agenttest.New()
+	defer fake.Close()
+
+	fake.QueueRequest("1", AgentActionGoroutines, nil)
+
+	agent := newTestAgent(&Options{})
+	useTestServer(t, agent, fake.Server)
+
+	poller := &actionPollerS{sensor: agent.sensor, actions: agentActions}
+	poller.poll()
+	poller.poll()
+
+	assert.Equal(t, 2, fake.Count(agenttest.Requests))
+	responses := fake.Responses()
+	if assert.Len(t, responses, 1) {
+		var resp agentActionResponseS
+		assert.NoError(t, json.Unmarshal(responses[0], &resp))
+		assert.Equal(t, "1", resp.MessageID)
+		assert.Empty(t, resp.Error)
+	}
+}
@@ -0,0 +1,109 @@
+package instana
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// splitBatch splits spans into batches of at most maxSpans spans and at
+// most maxBytes of serialized JSON each. A span exceeding maxBytes on its
+// own is put into a batch of its own and left to the agent to judge. The
+// serialized spans are kept, so they are not serialized again when posted.
+func splitBatch(spans []jsonSpan, maxSpans int, maxBytes int) [][]jsonSpan {
+	var batches [][]jsonSpan
+	var batch []jsonSpan
+
+	// the enclosing brackets of the JSON array
+	size := 2
+	for _, span := range spans {
+		j, err := json.Marshal(span)
+		if err != nil {
+			log.error("Dropping span that cannot be serialized:", err)
+			continue
+		}
+
+		// every span but the first is preceded by a comma
+		spanSize := len(j)
+		if len(batch) > 0 {
+			spanSize++
+		}
+
+		if len(batch) > 0 && (len(batch) == maxSpans || size+spanSize > maxBytes) {
+			batches = append(batches, batch)
+			batch = nil
+			size = 2
+			spanSize = len(j)
+		}
+
+		span.encoded = j
+		batch = append(batch, span)
+		size += spanSize
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+// encodeSpans serializes spans into a JSON array, reusing the encoding
+// splitBatch made where there is one.
+func encodeSpans(spans []jsonSpan) (json.RawMessage, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 64*len(spans)))
+	buf.WriteByte('[')
+	for i, span := range spans {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		j := span.encoded
+		if j == nil {
+			var err error
+			if j, err = json.Marshal(span); err != nil {
+				return nil, err
+			}
+		}
+		buf.Write(j)
+	}
+	buf.WriteByte(']')
+
+	return buf.Bytes(), nil
+}
+
+// postSpans posts a batch of spans to the agent. A batch the agent rejects
+// as too large is retried in halves, a single span it still rejects is
+// dropped. On failure the spans that were not delivered are returned.
+func (r *agentS) postSpans(spans []jsonSpan) ([]jsonSpan, error) {
+	payload, err := encodeSpans(spans)
+	if err != nil {
+		log.error("Dropping spans that cannot be serialized:", err)
+		return nil, nil
+	}
+
+	_, err = r.request(r.makeURL(agentTracesURL), "POST", payload)
+
+	e, ok := err.(*agentResponseError)
+	if !ok || e.code != http.StatusRequestEntityTooLarge {
+		if err != nil {
+			return spans, err
+		}
+
+		return nil, nil
+	}
+
+	if len(spans) == 1 {
+		log.info("Dropping span the agent rejected as too large:", spans[0].Data.SDK.Name)
+		return nil, nil
+	}
+
+	log.debug("Agent rejected batch as too large, splitting. Count:", len(spans))
+
+	mid := len(spans) / 2
+	if unsent, err := r.postSpans(spans[:mid]); err != nil {
+		return append(append([]jsonSpan(nil), unsent...), spans[mid:]...), err
+	}
+
+	return r.postSpans(spans[mid:])
+}
@@ -0,0 +1,161 @@
+package instana
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestSpans(n int, tagSize int) []jsonSpan {
+	spans := make([]jsonSpan, n)
+	for i := range spans {
+		spans[i] = jsonSpan{
+			SpanID: int64(i + 1),
+			Name:   "sdk",
+			Data: &jsonData{SDK: &jsonSDKData{
+				Name:   "op",
+				Custom: &jsonCustomData{Tags: map[string]interface{}{"payload": strings.Repeat("x", tagSize)}}}}}
+	}
+
+	return spans
+}
+
+func spanIDs(batches ...[]jsonSpan) []int64 {
+	var ids []int64
+	for _, batch := range batches {
+		for _, span := range batch {
+			ids = append(ids, span.SpanID)
+		}
+	}
+
+	return ids
+}
+
+func TestSplitBatch(t *testing.T) {
+	InitSensor(&Options{LogLevel: Debug})
+
+	spans := makeTestSpans(10, 100)
+	j, _ := json.Marshal(spans[:1])
+	spanSize := len(j) - 2
+
+	tests := []struct {
+		name     string
+		maxSpans int
+		maxBytes int
+		sizes    []int
+	}{
+		{"everything fits", 100, 1 << 20, []int{10}},
+		{"by span count", 4, 1 << 20, []int{4, 4, 2}},
+		{"by byte size", 100, 3*spanSize + 2 + 2, []int{3, 3, 3, 1}},
+		{"span count and byte size", 2, 3*spanSize + 2 + 2, []int{2, 2, 2, 2, 2}},
+		{"oversized spans", 100, 10, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+	}
+
+	for _, test := range tests {
+		batches := splitBatch(spans, test.maxSpans, test.maxBytes)
+
+		var sizes []int
+		for _, batch := range batches {
+			sizes = append(sizes, len(batch))
+
+			if len(batch) > 1 {
+				j, _ := json.Marshal(batch)
+				assert.True(t, len(j) <= test.maxBytes, "%s: batch exceeds byte limit", test.name)
+			}
+		}
+
+		assert.Equal(t, test.sizes, sizes, test.name)
+		assert.Equal(t, spanIDs(spans), spanIDs(batches...), "%s: spans should keep their order", test.name)
+	}
+}
+
+func TestPostSpansSplitsRejectedBatches(t *testing.T) {
+	var delivered [][]jsonSpan
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var spans []jsonSpan
+		json.NewDecoder(req.Body).Decode(&spans)
+
+		// accept at most two spans, and never span 7
+		for _, span := range spans {
+			if span.SpanID == 7 {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+		if len(spans) > 2 {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		delivered = append(delivered, spans)
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{})
+	useTestServer(t, agent, srv)
+
+	unsent, err := agent.postSpans(makeTestSpans(8, 10))
+
+	assert.NoError(t, err)
+	assert.Empty(t, unsent)
+	assert.Equal(t, []int64{1, 2, 3, 4, 5, 6, 8}, spanIDs(delivered...), "Only the rejected span should be lost")
+}
+
+func TestPostSpansReturnsUnsent(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		switch calls {
+		case 1:
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		case 2:
+			// first half delivered
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{})
+	useTestServer(t, agent, srv)
+
+	unsent, err := agent.postSpans(makeTestSpans(4, 10))
+
+	assert.Error(t, err)
+	assert.Equal(t, []int64{3, 4}, spanIDs(unsent), "Delivered half should not be returned")
+}
+
+func TestPostSpansReusesEncoding(t *testing.T) {
+	var got []json.RawMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{})
+	useTestServer(t, agent, srv)
+
+	spans := makeTestSpans(3, 10)
+	batches := splitBatch(spans, 100, 1<<20)
+	if !assert.Len(t, batches, 1) {
+		return
+	}
+
+	plain, _ := json.Marshal(spans)
+	encoded, err := encodeSpans(batches[0])
+	assert.NoError(t, err)
+	assert.Equal(t, string(plain), string(encoded))
+
+	// a span serialized by splitBatch is not serialized again
+	batches[0][1].encoded = []byte(`{"s":42}`)
+	_, err = agent.postSpans(batches[0])
+	assert.NoError(t, err)
+
+	if assert.Len(t, got, 3) {
+		assert.Equal(t, `{"s":42}`, string(got[1]))
+	}
+}
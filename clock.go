@@ -0,0 +1,40 @@
+package instana
+
+import "time"
+
+// clock is the source of time for the recorder, meter and agent timers. It
+// is replaced in tests to step through time instead of waiting for it.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) clockTimer
+}
+
+// clockTimer is a single shot timer created by a clock.
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type systemClockS struct{}
+
+type systemTimerS struct {
+	timer *time.Timer
+}
+
+var systemClock clock = systemClockS{}
+
+func (systemClockS) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClockS) NewTimer(d time.Duration) clockTimer {
+	return systemTimerS{timer: time.NewTimer(d)}
+}
+
+func (r systemTimerS) C() <-chan time.Time {
+	return r.timer.C
+}
+
+func (r systemTimerS) Stop() bool {
+	return r.timer.Stop()
+}
@@ -0,0 +1,245 @@
+package instana
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClockS only moves forward when advanced, firing the timers that are
+// due by then.
+type fakeClockS struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimerS
+}
+
+type fakeTimerS struct {
+	clock    *fakeClockS
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClockS {
+	return &fakeClockS{now: time.Unix(1500000000, 0)}
+}
+
+func (r *fakeClockS) Now() time.Time {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.now
+}
+
+func (r *fakeClockS) NewTimer(d time.Duration) clockTimer {
+	r.Lock()
+	defer r.Unlock()
+
+	timer := &fakeTimerS{clock: r, deadline: r.now.Add(d), c: make(chan time.Time, 1)}
+	r.timers = append(r.timers, timer)
+
+	return timer
+}
+
+// Advance moves the clock forward by d.
+func (r *fakeClockS) Advance(d time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.now = r.now.Add(d)
+
+	var pending []*fakeTimerS
+	for _, timer := range r.timers {
+		if timer.deadline.After(r.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- r.now
+	}
+	r.timers = pending
+}
+
+// waitTimers waits until n timers are pending.
+func (r *fakeClockS) waitTimers(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		r.Lock()
+		pending := len(r.timers)
+		r.Unlock()
+
+		if pending == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for %d pending timers", n)
+}
+
+func (r *fakeTimerS) C() <-chan time.Time {
+	return r.c
+}
+
+func (r *fakeTimerS) Stop() bool {
+	r.clock.Lock()
+	defer r.clock.Unlock()
+
+	for i, timer := range r.clock.timers {
+		if timer == r {
+			r.clock.timers = append(r.clock.timers[:i], r.clock.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestSetOptionsIntervals(t *testing.T) {
+	InitSensor(&Options{LogLevel: Debug})
+
+	s := &sensorS{}
+	s.setOptions(&Options{})
+	assert.Equal(t, DefaultFlushInterval, s.options.FlushInterval)
+	assert.Equal(t, DefaultMetricsInterval, s.options.MetricsInterval)
+	assert.Equal(t, DefaultSnapshotInterval, s.options.SnapshotInterval)
+	assert.Equal(t, DefaultAgentRetryPeriod, s.options.AgentRetryPeriod)
+	assert.Equal(t, DefaultAgentMaxRetries, s.options.AgentMaxRetries)
+
+	s.setOptions(&Options{
+		FlushInterval:    time.Minute,
+		MetricsInterval:  10 * time.Second,
+		SnapshotInterval: time.Hour,
+		AgentRetryPeriod: 5 * time.Second,
+		AgentMaxRetries:  5})
+	assert.Equal(t, time.Minute, s.options.FlushInterval)
+	assert.Equal(t, 10*time.Second, s.options.MetricsInterval)
+	assert.Equal(t, time.Hour, s.options.SnapshotInterval)
+	assert.Equal(t, 5*time.Second, s.options.AgentRetryPeriod)
+	assert.Equal(t, 5, s.options.AgentMaxRetries)
+
+	s.setOptions(&Options{
+		FlushInterval:    -time.Second,
+		MetricsInterval:  -time.Second,
+		SnapshotInterval: -time.Second,
+		AgentRetryPeriod: -time.Second,
+		AgentMaxRetries:  -1})
+	assert.Equal(t, DefaultFlushInterval, s.options.FlushInterval)
+	assert.Equal(t, DefaultMetricsInterval, s.options.MetricsInterval)
+	assert.Equal(t, DefaultSnapshotInterval, s.options.SnapshotInterval)
+	assert.Equal(t, DefaultAgentRetryPeriod, s.options.AgentRetryPeriod)
+	assert.Equal(t, DefaultAgentMaxRetries, s.options.AgentMaxRetries)
+
+	s.setOptions(&Options{MetricsInterval: time.Minute, SnapshotInterval: time.Second})
+	assert.Equal(t, time.Minute, s.options.SnapshotInterval,
+		"The snapshot can't be sent more often than the metrics")
+}
+
+func TestRecorderFlushInterval(t *testing.T) {
+	posts := make(chan []jsonSpan, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var spans []jsonSpan
+		json.NewDecoder(req.Body).Decode(&spans)
+		posts <- spans
+	}))
+	defer srv.Close()
+
+	clock := newFakeClock()
+	agent := newTestAgent(&Options{FlushInterval: time.Minute})
+	agent.sensor.clock = clock
+	useTestServer(t, agent, srv)
+
+	recorder := &Recorder{sensor: agent.sensor}
+	recorder.init()
+	defer recorder.Stop()
+
+	recorder.RecordSpan(newTestSpan("flushed"))
+
+	clock.waitTimers(t, 1)
+	clock.Advance(59 * time.Second)
+	assert.Equal(t, 1, recorder.QueuedSpansCount(), "Spans should be queued until the flush interval passed")
+
+	clock.Advance(time.Second)
+	select {
+	case spans := <-posts:
+		assert.Len(t, spans, 1)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Spans were not sent after the flush interval")
+	}
+}
+
+func TestMeterIntervals(t *testing.T) {
+	snapshots := make(chan bool, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var d EntityData
+		json.NewDecoder(req.Body).Decode(&d)
+		snapshots <- d.Snapshot != nil
+	}))
+	defer srv.Close()
+
+	clock := newFakeClock()
+	agent := newTestAgent(&Options{MetricsInterval: 10 * time.Second, SnapshotInterval: 30 * time.Second})
+	agent.sensor.clock = clock
+	useTestServer(t, agent, srv)
+
+	meter := &meterS{sensor: agent.sensor}
+	meter.init()
+
+	for i, snapshot := range []bool{true, false, false, true, false} {
+		clock.waitTimers(t, 1)
+		clock.Advance(10 * time.Second)
+
+		select {
+		case got := <-snapshots:
+			assert.Equal(t, snapshot, got, "Report %d", i)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Metrics were not sent after %d intervals", i+1)
+		}
+	}
+}
+
+func TestAgentRetryPeriod(t *testing.T) {
+	announces := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/":
+			w.Header().Set("Server", agentHeader)
+		case agentDiscoveryURL:
+			announces <- struct{}{}
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	clock := newFakeClock()
+	agent := newTestAgent(&Options{AgentRetryPeriod: time.Minute, AgentMaxRetries: 3})
+	agent.sensor.clock = clock
+
+	expectAnnounce := func(msg string) {
+		select {
+		case <-announces:
+		case <-time.After(5 * time.Second):
+			t.Fatal(msg)
+		}
+	}
+
+	useTestAgentDiscovery(t, agent, srv)
+	agent.initFsm()
+	expectAnnounce("The sensor should announce after the lookup")
+
+	for i := 1; i < 3; i++ {
+		clock.waitTimers(t, 1)
+		clock.Advance(59 * time.Second)
+		assert.Len(t, announces, 0, "Announce should not be retried before the retry period passed")
+
+		clock.Advance(time.Second)
+		expectAnnounce("Announce should be retried after the retry period")
+	}
+
+	// out of retries the sensor starts over with the lookup right away
+	expectAnnounce("The sensor should look the agent up again after AgentMaxRetries")
+}
@@ -0,0 +1,51 @@
+// Command instana-traces prints the trace trees of a span dump, either a
+// JSON array of spans or the output of the JSONRecorder.
+//
+// Usage:
+//
+//	instana-traces [file ...]
+//
+// The spans are read from stdin if no file is given.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/instana/golang-sensor"
+)
+
+func main() {
+	var spans instana.RecordedSpans
+
+	if len(os.Args) < 2 {
+		s, err := instana.ReadRecordedSpans(os.Stdin)
+		exitOnError("stdin", err)
+		spans = s
+	}
+
+	for _, path := range os.Args[1:] {
+		s, err := readFile(path)
+		exitOnError(path, err)
+		spans = append(spans, s...)
+	}
+
+	exitOnError("stdout", instana.WriteTraces(os.Stdout, instana.BuildTraces(spans)))
+}
+
+func readFile(path string) (instana.RecordedSpans, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return instana.ReadRecordedSpans(f)
+}
+
+func exitOnError(name string, err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "instana-traces: %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,136 @@
+package instana
+
+import "strconv"
+
+// samplingBuckets is the resolution of the sampling decision
+const samplingBuckets = 10000
+
+// agentSecretsConfig is the secrets configuration of the agent.
+type agentSecretsConfig struct {
+	Matcher string   `json:"matcher"`
+	List    []string `json:"list"`
+}
+
+// agentTracingConfig is the tracing configuration of the agent. Settings
+// left out by the agent are nil.
+type agentTracingConfig struct {
+	Enabled          *bool    `json:"enabled"`
+	SamplingRate     *float64 `json:"sampling-rate"`
+	ExtraHTTPHeaders []string `json:"extra-http-headers"`
+}
+
+// configS holds the settings the sensor runs with: the local Options
+// merged with the configuration the agent returned on announce. Local
+// Options take precedence where they are set; DisableTracing false and
+// SamplingRate 0 count as unset.
+type configS struct {
+	secrets          *secretsMatcherS
+	extraHTTPHeaders []string
+	tracingDisabled  bool
+	samplingRate     float64
+}
+
+// newConfig merges options with the announce response of the agent,
+// resp is nil before the sensor is announced.
+func newConfig(options *Options, resp *agentResponse) *configS {
+	ret := &configS{
+		extraHTTPHeaders: options.ExtraHTTPHeaders,
+		tracingDisabled:  options.DisableTracing,
+		samplingRate:     options.SamplingRate}
+
+	switch {
+	case options.SecretsMatcher != "":
+		secrets, err := newSecretsMatcher(options.SecretsMatcher, options.SecretsList)
+		if err != nil {
+			log.warn("Invalid secrets configuration, using the default:", err)
+		}
+		ret.secrets = secrets
+	case resp != nil && resp.Secrets != nil:
+		secrets, err := newSecretsMatcher(resp.Secrets.Matcher, resp.Secrets.List)
+		if err != nil {
+			log.warn("Ignoring the secrets configuration of the agent:", err)
+		}
+		ret.secrets = secrets
+	}
+
+	if ret.secrets == nil {
+		ret.secrets = defaultSecretsMatcher()
+	}
+
+	if resp == nil {
+		return ret
+	}
+
+	if len(ret.extraHTTPHeaders) == 0 {
+		ret.extraHTTPHeaders = resp.ExtraHTTPHeaders
+	}
+
+	if resp.Tracing == nil {
+		return ret
+	}
+
+	if len(options.ExtraHTTPHeaders) == 0 && len(resp.Tracing.ExtraHTTPHeaders) > 0 {
+		ret.extraHTTPHeaders = resp.Tracing.ExtraHTTPHeaders
+	}
+
+	if resp.Tracing.Enabled != nil && !*resp.Tracing.Enabled {
+		ret.tracingDisabled = true
+	}
+
+	if rate := resp.Tracing.SamplingRate; ret.samplingRate == 0 && rate != nil {
+		if *rate > 0 && *rate <= 1 {
+			ret.samplingRate = *rate
+		} else {
+			log.warn("Ignoring the sampling rate of the agent:", strconv.FormatFloat(*rate, 'g', -1, 64))
+		}
+	}
+
+	return ret
+}
+
+// records reports whether spans of the trace traceID are recorded. The
+// decision only depends on the trace ID, so all spans of a trace are
+// kept or dropped together.
+func (r *configS) records(traceID int64) bool {
+	if r.tracingDisabled {
+		return false
+	}
+
+	if r.samplingRate == 0 || r.samplingRate >= 1 {
+		return true
+	}
+
+	bucket := uint64(traceID) % samplingBuckets
+
+	return float64(bucket) < r.samplingRate*samplingBuckets
+}
+
+func (r *sensorS) setConfig(config *configS) {
+	r.configMu.Lock()
+	defer r.configMu.Unlock()
+
+	r.config = config
+}
+
+// getConfig returns the settings the sensor currently runs with.
+func (r *sensorS) getConfig() *configS {
+	r.configMu.RLock()
+	config := r.config
+	r.configMu.RUnlock()
+
+	if config == nil {
+		return newConfig(r.options, nil)
+	}
+
+	return config
+}
+
+// applyAgentConfig merges the announce response of the agent into the
+// settings the sensor runs with.
+func (r *sensorS) applyAgentConfig(resp *agentResponse) {
+	config := newConfig(r.options, resp)
+	r.setConfig(config)
+
+	log.debug("applied agent configuration, tracing disabled:", config.tracingDisabled,
+		"sampling rate:", config.samplingRate, "secrets matcher:", config.secrets.matcher)
+}
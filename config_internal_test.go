@@ -0,0 +1,158 @@
+package instana
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAnnounceResponse = `{
+	"pid": 4242,
+	"agentUuid": "agent-id",
+	"secrets": {"matcher": "equals", "list": ["token"]},
+	"extraHeaders": ["X-Legacy"],
+	"tracing": {
+		"enabled": false,
+		"sampling-rate": 0.25,
+		"extra-http-headers": ["X-Request-Id", "X-Tenant"]
+	}
+}`
+
+func TestSecretsMatcher(t *testing.T) {
+	for _, example := range []struct {
+		matcher  string
+		list     []string
+		key      string
+		expected bool
+	}{
+		{SecretsEqualsIgnoreCase, []string{"Token"}, "TOKEN", true},
+		{SecretsEqualsIgnoreCase, []string{"token"}, "tokens", false},
+		{SecretsEquals, []string{"token"}, "token", true},
+		{SecretsEquals, []string{"token"}, "Token", false},
+		{SecretsContainsIgnoreCase, []string{"pass"}, "X-Password", true},
+		{SecretsContains, []string{"pass"}, "X-Password", false},
+		{SecretsContains, []string{"Pass"}, "X-Password", true},
+		{SecretsRegex, []string{"x-.*-key"}, "x-api-key", true},
+		{SecretsRegex, []string{"key"}, "x-api-key", false},
+		{SecretsNone, []string{"key"}, "key", false},
+	} {
+		m, err := newSecretsMatcher(example.matcher, example.list)
+		if assert.NoError(t, err) {
+			assert.Equal(t, example.expected, m.match(example.key), "%s %v %s", example.matcher, example.list, example.key)
+		}
+	}
+
+	_, err := newSecretsMatcher("unknown", nil)
+	assert.Error(t, err)
+	_, err = newSecretsMatcher(SecretsRegex, []string{"("})
+	assert.Error(t, err)
+
+	assert.True(t, defaultSecretsMatcher().match("X-Api-Key"))
+	assert.False(t, defaultSecretsMatcher().match("X-Request-Id"))
+}
+
+func TestNewConfig(t *testing.T) {
+	InitSensor(&Options{LogLevel: Error})
+
+	var resp agentResponse
+	assert.NoError(t, json.Unmarshal([]byte(testAnnounceResponse), &resp))
+
+	config := newConfig(&Options{}, nil)
+	assert.Equal(t, DefaultSecretsMatcher, config.secrets.matcher)
+	assert.False(t, config.tracingDisabled)
+	assert.Equal(t, 0.0, config.samplingRate)
+	assert.Empty(t, config.extraHTTPHeaders)
+
+	config = newConfig(&Options{}, &resp)
+	assert.Equal(t, SecretsEquals, config.secrets.matcher)
+	assert.True(t, config.secrets.match("token"))
+	assert.True(t, config.tracingDisabled)
+	assert.Equal(t, 0.25, config.samplingRate)
+	assert.Equal(t, []string{"X-Request-Id", "X-Tenant"}, config.extraHTTPHeaders)
+
+	// local options take precedence
+	config = newConfig(&Options{
+		SecretsMatcher:   SecretsContains,
+		SecretsList:      []string{"auth"},
+		SamplingRate:     0.5,
+		ExtraHTTPHeaders: []string{"User-Agent"}}, &resp)
+	assert.Equal(t, SecretsContains, config.secrets.matcher)
+	assert.True(t, config.secrets.match("authorization"))
+	assert.False(t, config.secrets.match("token"))
+	assert.Equal(t, 0.5, config.samplingRate)
+	assert.Equal(t, []string{"User-Agent"}, config.extraHTTPHeaders)
+
+	// invalid settings are ignored
+	resp = agentResponse{
+		Secrets: &agentSecretsConfig{Matcher: "unknown"},
+		Tracing: &agentTracingConfig{SamplingRate: new(float64)}}
+	config = newConfig(&Options{}, &resp)
+	assert.Equal(t, DefaultSecretsMatcher, config.secrets.matcher)
+	assert.Equal(t, 0.0, config.samplingRate)
+
+	config = newConfig(&Options{SecretsMatcher: "unknown"}, nil)
+	assert.Equal(t, DefaultSecretsMatcher, config.secrets.matcher)
+}
+
+func TestConfigRecords(t *testing.T) {
+	assert.True(t, (&configS{}).records(randomID()))
+	assert.False(t, (&configS{tracingDisabled: true}).records(randomID()))
+
+	config := &configS{samplingRate: 0.25}
+	var kept int
+	for i := 0; i < 10000; i++ {
+		traceID := randomID()
+		if config.records(traceID) {
+			kept++
+		}
+		assert.Equal(t, config.records(traceID), config.records(traceID), "Sampling should be deterministic")
+	}
+	assert.InDelta(t, 2500, kept, 300)
+}
+
+func TestAgentConfigApplied(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/":
+			w.Header().Set("Server", agentHeader)
+		case agentDiscoveryURL:
+			w.Write([]byte(testAnnounceResponse))
+		}
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{AgentRetryPeriod: time.Millisecond})
+	useTestAgentDiscovery(t, agent, srv)
+	agent.initFsm()
+	waitAgentReady(t, agent)
+
+	assert.Equal(t, "4242", agent.getFrom().PID)
+	assert.True(t, agent.sensor.getConfig().tracingDisabled)
+
+	recorder := &Recorder{sensor: agent.sensor, testMode: true}
+	recorder.init()
+	recorder.RecordSpan(newTestSpan("dropped"))
+	assert.Equal(t, 0, recorder.QueuedSpansCount(), "Spans should be dropped once the agent disabled tracing")
+}
+
+func TestAgentConfigAppliesToAllRecorders(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracerWithEverything(&Options{LogLevel: Error}, NewJSONRecorder(&buf, false))
+
+	// the sensor may have been initialized by an earlier test already
+	config := sensor.getConfig()
+	defer sensor.setConfig(config)
+	sensor.setConfig(newConfig(&Options{}, &agentResponse{Tracing: &agentTracingConfig{Enabled: new(bool)}}))
+
+	tracer.StartSpan("dropped").Finish()
+	assert.Equal(t, 0, buf.Len(), "Spans should be dropped once the agent disabled tracing")
+
+	sensor.setConfig(newConfig(&Options{}, nil))
+	tracer.StartSpan("kept").Finish()
+	assert.Contains(t, buf.String(), "kept")
+}
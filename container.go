@@ -0,0 +1,83 @@
+package instana
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	procSelfCgroup    = "/proc/self/cgroup"
+	procSelfMountinfo = "/proc/self/mountinfo"
+)
+
+var (
+	// a container ID as the last element of a cgroup path, e.g.
+	// /docker/<id>, /kubepods/.../<id> or /system.slice/docker-<id>.scope
+	cgroupContainerID = regexp.MustCompile(`(?:^|[/-])([0-9a-f]{64})(?:\.scope)?$`)
+	// a container ID in the path of a file the runtime mounts into the
+	// container, e.g. /var/lib/docker/containers/<id>/hostname
+	mountContainerID = regexp.MustCompile(`/(?:docker/containers|overlay-containers|sandboxes)/([0-9a-f]{64})/`)
+)
+
+// containerID returns the ID of the container this process runs in, or an
+// empty string if it does not run in a container or the ID can't be told.
+func containerID(cgroupPath, mountinfoPath string) string {
+	if id := readContainerID(cgroupPath, parseCgroupContainerID); id != "" {
+		return id
+	}
+
+	// with cgroup v2 and a private cgroup namespace the cgroup path is
+	// just /, the mounts still give the container away
+	return readContainerID(mountinfoPath, parseMountinfoContainerID)
+}
+
+func readContainerID(path string, parse func(io.Reader) string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	return parse(f)
+}
+
+// parseCgroupContainerID looks for a container ID in the cgroup paths of
+// /proc/<pid>/cgroup. Lines are hierarchy-ID:controllers:path, cgroup v2
+// has a single line with ID 0 and no controllers.
+func parseCgroupContainerID(r io.Reader) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) < 3 {
+			continue
+		}
+
+		if match := cgroupContainerID.FindStringSubmatch(fields[2]); match != nil {
+			return match[1]
+		}
+	}
+
+	return ""
+}
+
+// parseMountinfoContainerID looks for a container ID in the mount roots
+// of /proc/<pid>/mountinfo.
+func parseMountinfoContainerID(r io.Reader) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// mount ID, parent ID, major:minor, root, mount point, ...
+		if len(fields) < 5 {
+			continue
+		}
+
+		if match := mountContainerID.FindStringSubmatch(fields[3]); match != nil {
+			return match[1]
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,33 @@
+package instana
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testContainerID = "3f1d9b2c4e5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c"
+
+func TestContainerID(t *testing.T) {
+	InitSensor(&Options{LogLevel: Error})
+
+	for name, example := range map[string]struct {
+		cgroup, mountinfo string
+		expected          string
+	}{
+		"cgroup v1 docker":         {"v1-docker", "host", testContainerID},
+		"cgroup v1 kubernetes":     {"v1-kubernetes", "host", testContainerID},
+		"cgroup v2 docker":         {"v2-docker", "host", testContainerID},
+		"cgroup v2 containerd":     {"v2-containerd", "host", testContainerID},
+		"cgroup namespace":         {"v2-namespace", "docker", testContainerID},
+		"cgroup namespace, podman": {"v2-namespace", "podman", testContainerID},
+		"host":                     {"v1-host", "host", ""},
+		"host, cgroup v2":          {"v2-namespace", "host", ""},
+		"no proc files":            {"missing", "missing", ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, example.expected,
+				containerID("testdata/cgroup/"+example.cgroup, "testdata/mountinfo/"+example.mountinfo))
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package instana
+
+import (
+	"net"
+	"os"
+)
+
+// AgentDiscoverySource provides candidate hosts the agent may be running
+// on. Hosts is called on every lookup, so sources may depend on the
+// environment at that time.
+type AgentDiscoverySource struct {
+	// Name is logged once the agent is found through this source
+	Name  string
+	Hosts func() []string
+}
+
+// DiscoverHosts returns a source providing the given host names or IPs.
+func DiscoverHosts(hosts ...string) AgentDiscoverySource {
+	return AgentDiscoverySource{
+		Name:  "hosts",
+		Hosts: func() []string { return hosts }}
+}
+
+// DiscoverEnv returns a source providing the host set in the environment
+// variable env.
+func DiscoverEnv(env string) AgentDiscoverySource {
+	return AgentDiscoverySource{
+		Name:  "env " + env,
+		Hosts: func() []string { return []string{os.Getenv(env)} }}
+}
+
+// kubernetesServiceAccountDir is mounted into pods that run with a
+// service account, which they do by default.
+const kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesHostIPEnvs are the environment variables the IP of the node is
+// commonly exposed as, from status.hostIP through the downward API.
+var kubernetesHostIPEnvs = []string{"HOST_IP", "NODE_IP", "K8S_NODE_IP"}
+
+// DiscoverKubernetesHostIP returns a source providing the IP of the
+// Kubernetes node the pod runs on, for agents deployed as a DaemonSet.
+// The IP is read from the environment variables envs, HOST_IP, NODE_IP
+// and K8S_NODE_IP if none are given, populated from status.hostIP through
+// the downward API. Outside of Kubernetes the source provides no hosts.
+func DiscoverKubernetesHostIP(envs ...string) AgentDiscoverySource {
+	if len(envs) == 0 {
+		envs = kubernetesHostIPEnvs
+	}
+
+	return AgentDiscoverySource{
+		Name:  "kubernetes host IP",
+		Hosts: func() []string { return kubernetesHostIPs(kubernetesServiceAccountDir, envs) }}
+}
+
+// kubernetesHostIPs returns the IPs set in the environment variables envs
+// if the process runs in a Kubernetes pod, told by the service environment
+// variables every pod gets or the service account mounted at
+// serviceAccountDir.
+func kubernetesHostIPs(serviceAccountDir string, envs []string) []string {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		if _, err := os.Stat(serviceAccountDir); err != nil {
+			return nil
+		}
+	}
+
+	var ret []string
+	for _, env := range envs {
+		ip := os.Getenv(env)
+		if ip == "" {
+			continue
+		}
+
+		if net.ParseIP(ip) == nil {
+			log.debug("ignoring", env, "it is not an IP:", ip)
+			continue
+		}
+		ret = append(ret, ip)
+	}
+
+	return ret
+}
+
+// DiscoverDefaultGateway returns a source providing the default gateways,
+// where the agent can be reached from within a container.
+func DiscoverDefaultGateway() AgentDiscoverySource {
+	return AgentDiscoverySource{
+		Name: "default gateway",
+		Hosts: func() []string {
+			gateways, err := defaultGateways(procNetRoute, nativeByteOrder())
+			if err != nil {
+				log.debug("cannot read the routing table", err)
+			}
+
+			return gateways
+		}}
+}
+
+// DiscoverDNS returns a source providing the given DNS names that
+// currently resolve, e.g. the name of a Kubernetes service in front of
+// the agents.
+func DiscoverDNS(names ...string) AgentDiscoverySource {
+	return AgentDiscoverySource{
+		Name: "dns",
+		Hosts: func() []string {
+			var hosts []string
+			for _, name := range names {
+				if _, err := net.LookupHost(name); err != nil {
+					log.debug("cannot resolve", name, err)
+					continue
+				}
+				hosts = append(hosts, name)
+			}
+
+			return hosts
+		}}
+}
+
+// defaultAgentDiscovery is used when Options.AgentDiscovery is empty: the
+// configured host, or else INSTANA_AGENT_HOST, or else localhost, followed
+// by the default gateway. A configured host is never mixed with localhost.
+func (r *sensorS) defaultAgentDiscovery() []AgentDiscoverySource {
+	var source AgentDiscoverySource
+	switch {
+	case r.options.AgentHost != "":
+		source = DiscoverHosts(r.options.AgentHost)
+		source.Name = "options"
+	case os.Getenv("INSTANA_AGENT_HOST") != "":
+		source = DiscoverEnv("INSTANA_AGENT_HOST")
+	default:
+		source = DiscoverHosts(agentDefaultHost)
+	}
+
+	return []AgentDiscoverySource{source, DiscoverDefaultGateway()}
+}
+
+type agentCandidateS struct {
+	host   string
+	source string
+}
+
+// discoverAgent probes the hosts of all discovery sources concurrently.
+// The first host in source order that answers as an agent wins, so a host
+// is only picked once all hosts ahead of it have failed.
+func (r *fsmS) discoverAgent() (host string, source string, ok bool) {
+	sources := r.agent.sensor.options.AgentDiscovery
+	if len(sources) == 0 {
+		sources = r.agent.sensor.defaultAgentDiscovery()
+	}
+
+	if path := r.agent.sensor.options.AgentSocket; path != "" {
+		// all requests go over the socket, there is no host to look up
+		sources = []AgentDiscoverySource{{
+			Name:  "socket " + path,
+			Hosts: func() []string { return []string{agentDefaultHost} }}}
+	}
+
+	var candidates []agentCandidateS
+	seen := make(map[string]bool)
+	for _, s := range sources {
+		for _, h := range s.Hosts() {
+			if h == "" || seen[h] {
+				continue
+			}
+			seen[h] = true
+			candidates = append(candidates, agentCandidateS{host: h, source: s.Name})
+		}
+	}
+
+	results := make([]chan bool, len(candidates))
+	for i, c := range candidates {
+		res := make(chan bool, 1)
+		results[i] = res
+		go r.checkHost(c.host, func(b bool, _ string) { res <- b })
+	}
+
+	for i, c := range candidates {
+		if <-results[i] {
+			return c.host, c.source, true
+		}
+	}
+
+	return "", "", false
+}
@@ -0,0 +1,164 @@
+package instana
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newHostServer starts a server at addr, answering as an agent or as some
+// other server after delay.
+func newHostServer(t *testing.T, addr string, isAgent bool, delay time.Duration) *httptest.Server {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("cannot listen on", addr, err)
+	}
+
+	srv := &httptest.Server{
+		Listener: ln,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(delay)
+			if isAgent {
+				w.Header().Set("Server", agentHeader)
+			}
+		})}}
+	srv.Start()
+
+	return srv
+}
+
+func newDiscoveryTestAgent(sources ...AgentDiscoverySource) *fsmS {
+	agent := newTestAgent(&Options{AgentDiscovery: sources})
+
+	return &fsmS{agent: agent}
+}
+
+func TestDiscoverAgent(t *testing.T) {
+	agentSrv := newHostServer(t, "127.0.0.1:0", true, 0)
+	defer agentSrv.Close()
+
+	_, port, _ := net.SplitHostPort(agentSrv.Listener.Addr().String())
+	otherSrv := newHostServer(t, "127.0.0.2:"+port, false, 0)
+	defer otherSrv.Close()
+
+	r := newDiscoveryTestAgent(
+		DiscoverHosts("127.0.0.3"),
+		AgentDiscoverySource{Name: "custom", Hosts: func() []string { return []string{"127.0.0.2"} }},
+		DiscoverHosts("127.0.0.1"))
+	r.agent.sensor.options.AgentPort, _ = strconv.Atoi(port)
+
+	host, source, ok := r.discoverAgent()
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1", host, "The first host answering as an agent should be picked")
+	assert.Equal(t, "hosts", source)
+}
+
+func TestDiscoverAgentOrder(t *testing.T) {
+	slowSrv := newHostServer(t, "127.0.0.1:0", true, 100*time.Millisecond)
+	defer slowSrv.Close()
+
+	_, port, _ := net.SplitHostPort(slowSrv.Listener.Addr().String())
+	fastSrv := newHostServer(t, "127.0.0.2:"+port, true, 0)
+	defer fastSrv.Close()
+
+	os.Setenv("INSTANA_TEST_AGENT_HOST", "127.0.0.1")
+	defer os.Unsetenv("INSTANA_TEST_AGENT_HOST")
+
+	r := newDiscoveryTestAgent(
+		DiscoverEnv("INSTANA_TEST_AGENT_HOST"),
+		DiscoverHosts("127.0.0.2"))
+	r.agent.sensor.options.AgentPort, _ = strconv.Atoi(port)
+
+	host, source, ok := r.discoverAgent()
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1", host, "Earlier sources should take precedence over faster ones")
+	assert.Equal(t, "env INSTANA_TEST_AGENT_HOST", source)
+}
+
+func TestDiscoverAgentNotFound(t *testing.T) {
+	r := newDiscoveryTestAgent(
+		DiscoverEnv("INSTANA_TEST_UNSET"),
+		DiscoverKubernetesHostIP("INSTANA_TEST_UNSET"),
+		DiscoverHosts("127.0.0.3"))
+	r.agent.sensor.options.AgentPort = 1
+
+	_, _, ok := r.discoverAgent()
+	assert.False(t, ok)
+}
+
+func TestDiscoverySources(t *testing.T) {
+	os.Setenv("INSTANA_TEST_HOST_IP", "10.0.0.7")
+	defer os.Unsetenv("INSTANA_TEST_HOST_IP")
+
+	assert.Equal(t, []string{"a", "b"}, DiscoverHosts("a", "b").Hosts())
+	assert.Equal(t, []string{"10.0.0.7"}, DiscoverEnv("INSTANA_TEST_HOST_IP").Hosts())
+	assert.Equal(t, []string{"localhost"}, DiscoverDNS("localhost", "unresolvable.invalid").Hosts())
+}
+
+func TestKubernetesHostIPs(t *testing.T) {
+	if host, ok := os.LookupEnv("KUBERNETES_SERVICE_HOST"); ok {
+		os.Unsetenv("KUBERNETES_SERVICE_HOST")
+		defer os.Setenv("KUBERNETES_SERVICE_HOST", host)
+	}
+
+	os.Setenv("INSTANA_TEST_HOST_IP", "10.0.0.7")
+	defer os.Unsetenv("INSTANA_TEST_HOST_IP")
+	os.Setenv("INSTANA_TEST_NODE_NAME", "node-1")
+	defer os.Unsetenv("INSTANA_TEST_NODE_NAME")
+
+	envs := []string{"INSTANA_TEST_UNSET", "INSTANA_TEST_NODE_NAME", "INSTANA_TEST_HOST_IP"}
+
+	dir, err := ioutil.TempDir("", "serviceaccount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, kubernetesHostIPs(filepath.Join(dir, "missing"), envs), "Outside of Kubernetes no hosts should be provided")
+	assert.Equal(t, []string{"10.0.0.7"}, kubernetesHostIPs(dir, envs), "The service account should tell a pod")
+
+	os.Setenv("KUBERNETES_SERVICE_HOST", "10.96.0.1")
+	defer os.Unsetenv("KUBERNETES_SERVICE_HOST")
+	assert.Equal(t, []string{"10.0.0.7"}, kubernetesHostIPs(filepath.Join(dir, "missing"), envs), "The service environment should tell a pod")
+}
+
+func TestDefaultAgentDiscovery(t *testing.T) {
+	if host, ok := os.LookupEnv("INSTANA_AGENT_HOST"); ok {
+		os.Unsetenv("INSTANA_AGENT_HOST")
+		defer os.Setenv("INSTANA_AGENT_HOST", host)
+	}
+
+	r := newDiscoveryTestAgent()
+	hosts := func() [][]string {
+		var ret [][]string
+		for _, s := range r.agent.sensor.defaultAgentDiscovery() {
+			if s.Name != "default gateway" {
+				ret = append(ret, s.Hosts())
+			}
+		}
+
+		return ret
+	}
+
+	assert.Equal(t, [][]string{{agentDefaultHost}}, hosts())
+
+	os.Setenv("INSTANA_AGENT_HOST", "env.example.com")
+	defer os.Unsetenv("INSTANA_AGENT_HOST")
+	assert.Equal(t, [][]string{{"env.example.com"}}, hosts(), "INSTANA_AGENT_HOST should replace localhost")
+
+	r.agent.sensor.options.AgentHost = "agent.example.com"
+	sources := r.agent.sensor.defaultAgentDiscovery()
+	if assert.Len(t, sources, 2) {
+		assert.Equal(t, "options", sources[0].Name)
+		assert.Equal(t, []string{"agent.example.com"}, sources[0].Hosts(), "AgentHost should be the only host")
+		assert.Equal(t, "default gateway", sources[1].Name)
+	}
+}
@@ -0,0 +1,138 @@
+package instana
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	exporterFlushInterval = 1 * time.Second
+	exporterMaxBatch      = 500
+	exporterMaxQueue      = 10000
+	exporterTimeout       = 5 * time.Second
+)
+
+// exporterS queues converted spans and posts them in batches to a third
+// party collector. It backs the recorders exporting to other tracing
+// systems; encode turns a batch into the request body.
+type exporterS struct {
+	sync.Mutex
+	url    string
+	client *http.Client
+	encode func(batch []interface{}) interface{}
+	queue  []interface{}
+
+	flush     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func newExporter(url string, encode func(batch []interface{}) interface{}) *exporterS {
+	r := &exporterS{
+		url:    url,
+		client: &http.Client{Timeout: exporterTimeout},
+		encode: encode,
+		flush:  make(chan struct{}, 1),
+		done:   make(chan struct{})}
+
+	r.wg.Add(1)
+	go r.run()
+
+	return r
+}
+
+// add queues an item, dropping the oldest one once the queue is full.
+func (r *exporterS) add(item interface{}) {
+	r.Lock()
+	if len(r.queue) == exporterMaxQueue {
+		r.queue = r.queue[1:]
+	}
+	r.queue = append(r.queue, item)
+	full := len(r.queue) >= exporterMaxBatch
+	r.Unlock()
+
+	if full {
+		select {
+		case r.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *exporterS) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(exporterFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.flush:
+		case <-r.done:
+			r.send()
+			return
+		}
+
+		r.send()
+	}
+}
+
+// send posts everything queued so far in batches of exporterMaxBatch.
+func (r *exporterS) send() {
+	r.Lock()
+	queue := r.queue
+	r.queue = nil
+	r.Unlock()
+
+	for len(queue) > 0 {
+		n := len(queue)
+		if n > exporterMaxBatch {
+			n = exporterMaxBatch
+		}
+
+		if err := r.post(queue[:n]); err != nil {
+			log.info("Exporting spans failed:", err, r.url)
+		}
+		queue = queue[n:]
+	}
+}
+
+func (r *exporterS) post(batch []interface{}) error {
+	j, err := json.Marshal(r.encode(batch))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", r.url, bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &agentResponseError{code: resp.StatusCode, status: resp.Status}
+	}
+
+	log.debug("exporter response:", r.url, resp.Status)
+
+	return nil
+}
+
+// close sends the queued items and stops the exporter.
+func (r *exporterS) close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.wg.Wait()
+	})
+}
@@ -1,16 +1,11 @@
 package instana
 
 import (
-	"bufio"
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
-	"regexp"
 	"strconv"
-	"time"
-
-	f "github.com/looplab/fsm"
+	"sync"
 )
 
 const (
@@ -18,16 +13,39 @@ const (
 	eLookup   = "lookup"
 	eAnnounce = "announce"
 	eTest     = "test"
-
-	retryPeriod    = 30 * 1000
-	maximumRetries = 2
+	eRetry    = "retry"
 )
 
+// fsmEventS is handled by the event loop. Results of lookup, announce and
+// test as well as retries carry the generation they were started in and
+// are dropped if the sensor started over in the meantime.
+type fsmEventS struct {
+	name string
+	gen  uint64
+	ok   bool
+	host string
+	resp *agentResponse
+	// closed once the event is handled
+	done chan struct{}
+}
+
+// fsmS takes the sensor through looking up the agent host, announcing
+// itself and testing the connection. A single goroutine runs the event
+// loop and owns the state; lookup, announce and test run in their own
+// goroutines and report back through events.
 type fsmS struct {
-	agent   *agentS
-	fsm     *f.FSM
-	timer   *time.Timer
+	agent    *agentS
+	events   chan fsmEventS
+	stopCh   chan struct{}
+	stopOnce sync.Once
+
+	// owned by the event loop
+	state   AgentState
+	gen     uint64
 	retries int
+	timer   clockTimer
+	// closed when the generation ends, cancels a pending retry
+	genDone chan struct{}
 }
 
 func (r *fsmS) init() {
@@ -35,208 +53,249 @@ func (r *fsmS) init() {
 	log.warn("Stan is on the scene.  Starting Instana instrumentation.")
 	log.debug("initializing fsm")
 
-	r.fsm = f.NewFSM(
-		"none",
-		f.Events{
-			{Name: eInit, Src: []string{"none", "unannounced", "announced", "ready"}, Dst: "init"},
-			{Name: eLookup, Src: []string{"init"}, Dst: "unannounced"},
-			{Name: eAnnounce, Src: []string{"unannounced"}, Dst: "announced"},
-			{Name: eTest, Src: []string{"announced"}, Dst: "ready"}},
-		f.Callbacks{
-			"init":              r.lookupAgentHost,
-			"enter_unannounced": r.announceSensor,
-			"enter_announced":   r.testAgent})
-
-	r.retries = maximumRetries
-	r.fsm.Event(eInit)
+	r.start(AgentNone)
+	r.send(fsmEventS{name: eInit})
 }
 
-func (r *fsmS) scheduleRetry(e *f.Event, cb func(e *f.Event)) {
-	r.timer = time.NewTimer(retryPeriod * time.Millisecond)
-	go func() {
-		<-r.timer.C
-		cb(e)
-	}()
+// start runs the event loop beginning in state.
+func (r *fsmS) start(state AgentState) {
+	r.events = make(chan fsmEventS)
+	r.stopCh = make(chan struct{})
+	r.genDone = make(chan struct{})
+	r.state = state
+	r.retries = r.agent.sensor.options.AgentMaxRetries
+	r.agent.state.set(state)
+
+	go r.run()
 }
 
-func (r *fsmS) lookupAgentHost(e *f.Event) {
-	cb := func(b bool, host string) {
-		if b {
-			r.lookupSuccess(host)
-		} else {
-			gateway := r.getDefaultGateway()
-			if gateway != "" {
-				go r.checkHost(gateway, func(b bool, host string) {
-					if b {
-						r.lookupSuccess(host)
-					} else {
-						log.error("Cannot connect to the agent through localhost or default gateway. Scheduling retry.")
-						r.scheduleRetry(e, r.lookupAgentHost)
-					}
-				})
-			} else {
-				log.error("Default gateway not available. Scheduling retry")
-				r.scheduleRetry(e, r.lookupAgentHost)
+func (r *fsmS) run() {
+	for {
+		select {
+		case e := <-r.events:
+			r.handle(e)
+			if e.done != nil {
+				close(e.done)
 			}
-		}
-	}
-	hostNames := []string{
-		r.agent.sensor.options.AgentHost,
-		os.Getenv("INSTANA_AGENT_HOST"),
-		agentDefaultHost,
-	}
-	for _, name := range hostNames {
-		if name != "" {
-			go r.checkHost(name, cb)
+		case <-r.stopCh:
+			close(r.genDone)
 			return
 		}
 	}
 }
 
-func (r *fsmS) getDefaultGateway() string {
-	out, _ := exec.Command("/bin/sh", "-c", "/sbin/ip route | awk '/default/' | cut -d ' ' -f 3 | tr -d '\n'").Output()
-
-	log.debug("checking default gateway", string(out[:]))
+// send hands an event to the loop, unless it is stopped.
+func (r *fsmS) send(e fsmEventS) {
+	select {
+	case r.events <- e:
+	case <-r.stopCh:
+	}
+}
 
-	return string(out[:])
+// stop ends the event loop. Lookups, announces and tests in flight are
+// dropped. Stopping it again has no effect.
+func (r *fsmS) stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopCh)
+	})
 }
 
-func (r *fsmS) checkHost(host string, cb func(b bool, host string)) {
-	log.debug("checking host", host)
+func (r *fsmS) handle(e fsmEventS) {
+	if e.name != eInit && e.gen != r.gen {
+		log.debug("dropping stale agent event", e.name)
+		return
+	}
 
-	header, err := r.agent.requestHeader(r.agent.makeHostURL(host, "/"), "GET", "Server")
+	maxRetries := r.agent.sensor.options.AgentMaxRetries
+
+	switch e.name {
+	case eInit:
+		r.startOver()
+	case eRetry:
+		r.enter(r.state)
+	case eLookup:
+		if !e.ok {
+			log.error("Cannot connect to the agent through any of the discovery sources. Scheduling retry.")
+			r.scheduleRetry()
+			return
+		}
 
-	cb(err == nil && header == agentHeader, host)
+		log.debug("agent lookup success", e.host)
+		r.agent.setHost(e.host)
+		r.retries = maxRetries
+		r.enter(AgentUnannounced)
+	case eAnnounce:
+		if !e.ok {
+			log.error("Cannot announce sensor. Scheduling retry.")
+			r.retryOrStartOver()
+			return
+		}
+
+		log.info("Host agent available. We're in business. Announced pid:", e.resp.Pid)
+		r.agent.setFrom(&fromS{
+			PID:    strconv.Itoa(int(e.resp.Pid)),
+			HostID: e.resp.HostID})
+		r.agent.sensor.applyAgentConfig(e.resp)
+		r.retries = maxRetries
+		r.enter(AgentAnnounced)
+	case eTest:
+		if !e.ok {
+			log.debug("Agent is not yet ready. Scheduling retry.")
+			r.retryOrStartOver()
+			return
+		}
+
+		r.retries = maxRetries
+		r.enter(AgentReady)
+	}
 }
 
-func (r *fsmS) lookupSuccess(host string) {
-	log.debug("agent lookup success", host)
+// startOver drops everything in flight of the current generation and
+// looks the agent up again.
+func (r *fsmS) startOver() {
+	r.gen++
+	close(r.genDone)
+	r.genDone = make(chan struct{})
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
 
-	r.agent.setHost(host)
-	r.retries = maximumRetries
-	r.fsm.Event(eLookup)
+	r.retries = r.agent.sensor.options.AgentMaxRetries
+	r.enter(AgentInit)
 }
 
-func (r *fsmS) announceSensor(e *f.Event) {
-	cb := func(b bool, from *fromS) {
-		if b {
-			log.info("Host agent available. We're in business. Announced pid:", from.PID)
-			r.agent.setFrom(from)
-			r.retries = maximumRetries
-			r.fsm.Event(eAnnounce)
-		} else {
-			log.error("Cannot announce sensor. Scheduling retry.")
-			r.retries--
-			if r.retries > 0 {
-				r.scheduleRetry(e, r.announceSensor)
-			} else {
-				r.fsm.Event(eInit)
-			}
-		}
+func (r *fsmS) retryOrStartOver() {
+	r.retries--
+	if r.retries > 0 {
+		r.scheduleRetry()
+		return
 	}
 
-	log.debug("announcing sensor to the agent")
+	r.startOver()
+}
 
-	go func(cb func(b bool, from *fromS)) {
-		defer func() {
-			if r := recover(); r != nil {
-				log.debug("Announce recovered:", r)
+// enter moves to state and starts its step in the background.
+func (r *fsmS) enter(state AgentState) {
+	r.state = state
+	r.agent.state.set(state)
+
+	gen := r.gen
+	switch state {
+	case AgentInit:
+		go func() {
+			host, source, ok := r.discoverAgent()
+			if ok {
+				log.info("Found the agent at", host, "through", source)
 			}
+			r.send(fsmEventS{name: eLookup, gen: gen, ok: ok, host: host})
 		}()
+	case AgentUnannounced:
+		log.debug("announcing sensor to the agent")
+		go func() {
+			resp, err := r.announceSensor()
+			r.send(fsmEventS{name: eAnnounce, gen: gen, ok: err == nil, resp: resp})
+		}()
+	case AgentAnnounced:
+		log.debug("testing communication with the agent")
+		go func() {
+			_, err := r.agent.head(r.agent.makeURL(agentDataURL))
+			r.send(fsmEventS{name: eTest, gen: gen, ok: err == nil})
+		}()
+	}
+}
 
-		pid := 0
-		schedFile := fmt.Sprintf("/proc/%d/sched", os.Getpid())
-		if _, err := os.Stat(schedFile); err == nil {
-			sf, err := os.Open(schedFile)
-			defer sf.Close()
-			if err == nil {
-				fscanner := bufio.NewScanner(sf)
-				fscanner.Scan()
-				primaLinea := fscanner.Text()
-
-				r := regexp.MustCompile("\\((\\d+),")
-				match := r.FindStringSubmatch(primaLinea)
-				i, err := strconv.Atoi(match[1])
-				if err == nil {
-					pid = i
-				}
-			}
-		}
+// scheduleRetry repeats the step of the current state after the
+// AgentRetryPeriod.
+func (r *fsmS) scheduleRetry() {
+	timer := r.agent.sensor.getClock().NewTimer(r.agent.sensor.options.AgentRetryPeriod)
+	r.timer = timer
 
-		if pid == 0 {
-			pid = os.Getpid()
+	gen, genDone := r.gen, r.genDone
+	go func() {
+		select {
+		case <-timer.C():
+			r.send(fsmEventS{name: eRetry, gen: gen})
+		case <-genDone:
 		}
+	}()
+}
 
-		d := &discoveryS{PID: pid}
-		d.Name, d.Args = getCommandLine()
+func (r *fsmS) checkHost(host string, cb func(b bool, host string)) {
+	log.debug("checking host", host)
 
-		if _, err := os.Stat("/proc"); err == nil {
-			if addr, err := net.ResolveTCPAddr("tcp", r.agent.host+":42699"); err == nil {
-				if tcpConn, err := net.DialTCP("tcp", nil, addr); err == nil {
-					defer tcpConn.Close()
+	header, err := r.agent.requestHeader(r.agent.makeHostURL(host, "/"), "GET", "Server")
+
+	cb(err == nil && header == agentHeader, host)
+}
+
+// announceSensor announces this process to the agent and returns its
+// response with the entity info the agent assigned and its configuration.
+func (r *fsmS) announceSensor() (*agentResponse, error) {
+	pid := schedFilePID(fmt.Sprintf("/proc/%d/sched", os.Getpid()))
+	if pid == 0 {
+		pid = os.Getpid()
+	}
+
+	d := &discoveryS{PID: pid, ContainerID: containerID(procSelfCgroup, procSelfMountinfo)}
+	d.Name, d.Args = getCommandLine()
+
+	// the agent matches the TCP connection to the process, which can't be
+	// done over a Unix domain socket or a transport of the application
+	options := r.agent.sensor.options
+	if _, err := os.Stat("/proc"); err == nil && options.AgentSocket == "" && options.AgentTransport == nil {
+		if addr, err := net.ResolveTCPAddr("tcp", r.agent.hostAddr()); err == nil {
+			if tcpConn, err := net.DialTCP("tcp", nil, addr); err == nil {
+				defer tcpConn.Close()
 
-					f, err := tcpConn.File()
+				f, err := tcpConn.File()
 
-					if err != nil {
-						log.error(err)
-					} else {
-						d.Fd = fmt.Sprintf("%v", f.Fd())
+				if err != nil {
+					log.error(err)
+				} else {
+					d.Fd = fmt.Sprintf("%v", f.Fd())
 
-						link := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), f.Fd())
-						if _, err := os.Stat(link); err == nil {
-							d.Inode, _ = os.Readlink(link)
-						}
+					link := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), f.Fd())
+					if _, err := os.Stat(link); err == nil {
+						d.Inode, _ = os.Readlink(link)
 					}
 				}
 			}
 		}
-
-		ret := &agentResponse{}
-		_, err := r.agent.requestResponse(r.agent.makeURL(agentDiscoveryURL), "PUT", d, ret)
-		cb(err == nil,
-			&fromS{
-				PID:    strconv.Itoa(int(ret.Pid)),
-				HostID: ret.HostID})
-	}(cb)
-}
-
-func (r *fsmS) testAgent(e *f.Event) {
-	cb := func(b bool) {
-		if b {
-			r.retries = maximumRetries
-			r.fsm.Event(eTest)
-		} else {
-			log.debug("Agent is not yet ready. Scheduling retry.")
-			r.retries--
-			if r.retries > 0 {
-				r.scheduleRetry(e, r.testAgent)
-			} else {
-				r.fsm.Event(eInit)
-			}
-		}
 	}
 
-	log.debug("testing communication with the agent")
+	ret := &agentResponse{}
+	if _, err := r.agent.requestResponse(r.agent.makeURL(agentDiscoveryURL), "PUT", d, ret); err != nil {
+		return nil, err
+	}
 
-	go func(cb func(b bool)) {
-		_, err := r.agent.head(r.agent.makeURL(agentDataURL))
-		cb(err == nil)
-	}(cb)
+	return ret, nil
 }
 
+// reset makes the sensor look the agent up again and announce itself. It
+// returns once the event loop has taken over, so the agent is no longer
+// ready by then.
 func (r *fsmS) reset() {
-	r.retries = maximumRetries
-	r.fsm.Event(eInit)
+	done := make(chan struct{})
+	r.send(fsmEventS{name: eInit, done: done})
+
+	select {
+	case <-done:
+	case <-r.stopCh:
+	}
 }
 
 func (r *agentS) initFsm() *fsmS {
 	ret := new(fsmS)
 	ret.agent = r
+	// set before the loop starts, so it is visible to all goroutines
+	// resetting the agent
+	r.fsm = ret
 	ret.init()
 
 	return ret
 }
 
 func (r *agentS) canSend() bool {
-	return r.fsm.fsm.Current() == "ready"
+	return r.agentless || r.state.get() == AgentReady
 }
@@ -0,0 +1,172 @@
+package instana
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFlakyAgentServer answers as an agent, failing announces and
+// connection tests while flaky is set.
+func newFlakyAgentServer(flaky *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/" {
+			w.Header().Set("Server", agentHeader)
+			return
+		}
+
+		if atomic.LoadInt32(flaky) == 1 && rand.Intn(2) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if req.URL.Path == agentDiscoveryURL {
+			w.Write([]byte(`{"pid":4242,"agentUuid":"agent-id"}`))
+		}
+	}))
+}
+
+func waitAgentReady(t *testing.T, agent *agentS) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := agent.state.waitReady(ctx); err != nil {
+		t.Fatal("agent did not get ready:", agent.state.get())
+	}
+}
+
+func TestFsmReset(t *testing.T) {
+	var flaky int32
+	srv := newFlakyAgentServer(&flaky)
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{AgentRetryPeriod: time.Millisecond})
+	useTestAgentDiscovery(t, agent, srv)
+	agent.initFsm()
+	waitAgentReady(t, agent)
+
+	agent.reset()
+	assert.False(t, agent.canSend(), "The agent should not be ready right after a reset")
+
+	waitAgentReady(t, agent)
+	assert.Equal(t, "4242", agent.getFrom().PID)
+}
+
+func TestFsmStop(t *testing.T) {
+	agent := newTestAgent(&Options{})
+	agent.fsm.stop()
+	assert.NotPanics(t, agent.fsm.stop, "Stopping twice should be a no-op")
+
+	done := make(chan struct{})
+	go func() {
+		agent.reset()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reset should not block once the fsm is stopped")
+	}
+}
+
+func TestFsmConcurrentResetsStress(t *testing.T) {
+	flaky := int32(1)
+	srv := newFlakyAgentServer(&flaky)
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{AgentRetryPeriod: time.Millisecond, AgentMaxRetries: 2})
+	useTestAgentDiscovery(t, agent, srv)
+	agent.initFsm()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				// mix resets with the reads senders do all the time
+				if i%2 == 0 {
+					agent.reset()
+				}
+				agent.canSend()
+				agent.makeURL(agentTracesURL)
+				agent.getFrom()
+				agent.getHost()
+				time.Sleep(time.Millisecond)
+			}
+		}(i)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	atomic.StoreInt32(&flaky, 0)
+	agent.reset()
+	waitAgentReady(t, agent)
+	assert.Equal(t, "4242", agent.getFrom().PID)
+}
+
+func TestFsmSendersResetStress(t *testing.T) {
+	var traces int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/":
+			w.Header().Set("Server", agentHeader)
+		case agentDiscoveryURL:
+			w.Write([]byte(`{"pid":4242,"agentUuid":"agent-id"}`))
+		case agentTracesURL + "4242":
+			// the agent forgets the process every now and then
+			if atomic.AddInt32(&traces, 1)%3 == 0 {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{
+		AgentRetryPeriod:            time.Millisecond,
+		FlushInterval:               time.Millisecond,
+		MetricsInterval:             time.Millisecond,
+		ForceTransmissionStartingAt: 1})
+	useTestAgentDiscovery(t, agent, srv)
+	agent.initFsm()
+	waitAgentReady(t, agent)
+
+	recorder := &Recorder{sensor: agent.sensor}
+	recorder.init()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				recorder.RecordSpan(newTestSpan("stress"))
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the fsm stops along with the recorder
+	waitAgentReady(t, agent)
+	recorder.Stop()
+
+	assert.True(t, atomic.LoadInt32(&traces) > 0, "Spans should have been sent")
+}
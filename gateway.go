@@ -0,0 +1,124 @@
+package instana
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+const procNetRoute = "/proc/net/route"
+
+// Route flags, see linux/route.h
+const (
+	routeFlagUp      = 0x1
+	routeFlagGateway = 0x2
+)
+
+// defaultGateways reads the gateways of the default routes from the kernel
+// routing table at path, with addresses in order, best route first.
+func defaultGateways(path string, order binary.ByteOrder) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseDefaultGateways(f, order)
+}
+
+// parseDefaultGateways parses a routing table in the /proc/net/route
+// format and returns the gateways of the default routes that are up,
+// ordered by metric. Addresses are hex encoded in order, the byte order of
+// the host that wrote the table.
+func parseDefaultGateways(r io.Reader, order binary.ByteOrder) ([]string, error) {
+	type route struct {
+		gateway string
+		metric  uint64
+	}
+
+	var routes []route
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		// skip the header and anything that does not look like a route
+		if line == 1 || len(fields) < 8 {
+			continue
+		}
+
+		destination, gateway, flags, metric, mask := fields[1], fields[2], fields[3], fields[6], fields[7]
+		if destination != "00000000" || mask != "00000000" {
+			continue
+		}
+
+		fl, err := strconv.ParseUint(flags, 16, 32)
+		if err != nil || fl&(routeFlagUp|routeFlagGateway) != routeFlagUp|routeFlagGateway {
+			continue
+		}
+
+		ip, err := parseRouteAddr(gateway, order)
+		if err != nil {
+			log.debug("Skipping malformed route", scanner.Text(), err)
+			continue
+		}
+
+		m, err := strconv.ParseUint(metric, 10, 32)
+		if err != nil {
+			log.debug("Skipping malformed route", scanner.Text(), err)
+			continue
+		}
+
+		routes = append(routes, route{gateway: ip.String(), metric: m})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].metric < routes[j].metric
+	})
+
+	gateways := make([]string, len(routes))
+	for i, r := range routes {
+		gateways[i] = r.gateway
+	}
+
+	return gateways, nil
+}
+
+// nativeByteOrder returns the byte order of the host, which the kernel
+// uses for the addresses in /proc/net/route: little endian on amd64 and
+// arm64, big endian on s390x for example.
+func nativeByteOrder() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+
+	return binary.BigEndian
+}
+
+// parseRouteAddr decodes an IPv4 address as found in /proc/net/route in
+// order, e.g. 0101A8C0 for 192.168.1.1 in little endian.
+func parseRouteAddr(s string, order binary.ByteOrder) (net.IP, error) {
+	if len(s) != 8 {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+
+	n, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := make(net.IP, net.IPv4len)
+	order.PutUint32(ip, uint32(n))
+
+	return ip, nil
+}
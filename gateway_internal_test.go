@@ -0,0 +1,88 @@
+package instana
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultGateways(t *testing.T) {
+	InitSensor(&Options{LogLevel: Debug})
+
+	examples := map[string]struct {
+		File     string
+		Expected []string
+	}{
+		"single default route": {
+			File:     "single",
+			Expected: []string{"172.17.0.1"}},
+		"multiple default routes by metric": {
+			File:     "multiple",
+			Expected: []string{"10.0.0.1", "192.168.1.1"}},
+		"no default route": {
+			File:     "no-default",
+			Expected: []string{}},
+		"routes down or without gateway": {
+			File:     "down",
+			Expected: []string{"192.168.1.254"}},
+		"malformed routes": {
+			File:     "malformed",
+			Expected: []string{"192.168.1.2"}},
+		"header only": {
+			File:     "empty",
+			Expected: []string{}},
+	}
+
+	// the routing tables were taken from little endian hosts
+	for name, example := range examples {
+		gateways, err := defaultGateways(filepath.Join("testdata", "route", example.File), binary.LittleEndian)
+		assert.NoError(t, err, name)
+		assert.Equal(t, example.Expected, gateways, name)
+	}
+}
+
+func TestDefaultGatewaysMissingFile(t *testing.T) {
+	_, err := defaultGateways(filepath.Join("testdata", "route", "missing"), binary.LittleEndian)
+	assert.Error(t, err)
+}
+
+func TestParseDefaultGatewaysEmpty(t *testing.T) {
+	gateways, err := parseDefaultGateways(strings.NewReader(""), binary.LittleEndian)
+	assert.NoError(t, err)
+	assert.Empty(t, gateways)
+}
+
+func TestParseRouteAddr(t *testing.T) {
+	examples := map[string]struct {
+		Addr     string
+		Expected string
+		Error    bool
+	}{
+		"private network": {Addr: "0101A8C0", Expected: "192.168.1.1"},
+		"docker bridge":   {Addr: "010011AC", Expected: "172.17.0.1"},
+		"lower case":      {Addr: "fe01a8c0", Expected: "192.168.1.254"},
+		"zero":            {Addr: "00000000", Expected: "0.0.0.0"},
+		"too short":       {Addr: "0101A8", Error: true},
+		"not hex":         {Addr: "ZZ01A8C0", Error: true},
+	}
+
+	for name, example := range examples {
+		ip, err := parseRouteAddr(example.Addr, binary.LittleEndian)
+		if example.Error {
+			assert.Error(t, err, name)
+			continue
+		}
+
+		assert.NoError(t, err, name)
+		assert.Equal(t, example.Expected, ip.String(), name)
+	}
+}
+
+func TestParseRouteAddrBigEndian(t *testing.T) {
+	ip, err := parseRouteAddr("C0A80101", binary.BigEndian)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.1", ip.String())
+}
@@ -0,0 +1,71 @@
+package instana
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	ot "github.com/opentracing/opentracing-go"
+)
+
+const (
+	// httpHeaderTagPrefix is the namespace of the tags captured headers
+	// are recorded under, followed by the lower case header name
+	httpHeaderTagPrefix = "http.header."
+	// maxHTTPHeaderTagLength limits the length of a captured header
+	// value, longer values are truncated
+	maxHTTPHeaderTagLength = 256
+)
+
+// TagHTTPHeaders records the values of the request or response headers
+// listed in ExtraHTTPHeaders, or configured in the agent, as tags of span,
+// e.g. X-Request-Id as http.header.x-request-id. Multiple values are
+// joined with a comma, secrets are masked.
+func TagHTTPHeaders(span ot.Span, h http.Header) {
+	if sensor == nil {
+		return
+	}
+
+	for k, v := range sensor.getConfig().httpHeaderTags(h) {
+		span.SetTag(k, v)
+	}
+}
+
+// httpHeaderTags returns the tags for the captured headers in h.
+func (r *configS) httpHeaderTags(h http.Header) map[string]string {
+	if len(r.extraHTTPHeaders) == 0 || len(h) == 0 {
+		return nil
+	}
+
+	ret := make(map[string]string)
+	for _, name := range r.extraHTTPHeaders {
+		values, ok := h[http.CanonicalHeaderKey(name)]
+		if !ok {
+			continue
+		}
+
+		value := SecretsMask
+		if !r.secrets.match(name) {
+			value = truncateHTTPHeader(strings.Join(values, ", "))
+		}
+
+		ret[httpHeaderTagPrefix+strings.ToLower(name)] = value
+	}
+
+	return ret
+}
+
+// truncateHTTPHeader cuts value to maxHTTPHeaderTagLength bytes, without
+// splitting a UTF-8 sequence.
+func truncateHTTPHeader(value string) string {
+	if len(value) <= maxHTTPHeaderTagLength {
+		return value
+	}
+
+	n := maxHTTPHeaderTagLength
+	for n > 0 && !utf8.RuneStart(value[n]) {
+		n--
+	}
+
+	return value[:n]
+}
@@ -0,0 +1,65 @@
+package instana
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPHeaderTags(t *testing.T) {
+	config := newConfig(&Options{ExtraHTTPHeaders: []string{"x-request-id", "X-Tenant", "X-Api-Key", "User-Agent"}}, nil)
+
+	h := http.Header{}
+	h.Set("X-Request-Id", "abc")
+	h.Add("X-Tenant", "a")
+	h.Add("X-Tenant", "b")
+	h.Set("X-Api-Key", "hunter2")
+	h.Set("Accept", "*/*")
+
+	assert.Equal(t, map[string]string{
+		"http.header.x-request-id": "abc",
+		"http.header.x-tenant":     "a, b",
+		"http.header.x-api-key":    SecretsMask}, config.httpHeaderTags(h))
+
+	assert.Nil(t, newConfig(&Options{}, nil).httpHeaderTags(h), "No headers are captured unless configured")
+}
+
+func TestTagHTTPHeaders(t *testing.T) {
+	recorder := NewTestRecorder()
+	tracer := NewTracerWithEverything(&Options{LogLevel: Error}, recorder)
+
+	// the sensor may have been initialized by an earlier test already
+	config := sensor.getConfig()
+	defer sensor.setConfig(config)
+	sensor.setConfig(newConfig(&Options{ExtraHTTPHeaders: []string{"x-request-id", "X-TENANT"}}, nil))
+
+	h := http.Header{}
+	h.Set("X-Request-Id", "abc")
+	h.Set("x-tenant", "acme")
+	h.Set("Accept", "*/*")
+
+	span := tracer.StartSpan("http")
+	TagHTTPHeaders(span, h)
+	span.Finish()
+
+	spans := recorder.GetQueuedSpans()
+	if assert.Len(t, spans, 1) {
+		tags := spans[0].Data.SDK.Custom.Tags
+		assert.Equal(t, "abc", tags["http.header.x-request-id"])
+		assert.Equal(t, "acme", tags["http.header.x-tenant"], "Header names should match regardless of case")
+		assert.NotContains(t, tags, "http.header.accept", "Headers not configured should not be captured")
+	}
+}
+
+func TestTruncateHTTPHeader(t *testing.T) {
+	assert.Equal(t, "short", truncateHTTPHeader("short"))
+
+	long := strings.Repeat("a", maxHTTPHeaderTagLength+10)
+	assert.Len(t, truncateHTTPHeader(long), maxHTTPHeaderTagLength)
+
+	// a multi-byte rune crossing the limit is dropped as a whole
+	long = strings.Repeat("a", maxHTTPHeaderTagLength-1) + "ü"
+	assert.Equal(t, strings.Repeat("a", maxHTTPHeaderTagLength-1), truncateHTTPHeader(long))
+}
@@ -0,0 +1,163 @@
+package instana
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	l "log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// jsonRecorderBackups is the number of rotated files a file backed
+// JSONRecorder keeps next to the current one.
+const jsonRecorderBackups = 3
+
+// JSONRecorder writes every finished span as JSON, in the format the agent
+// receives, to an io.Writer or a file. Spans are written one per line, in
+// pretty mode as indented JSON objects separated by a newline. It does not
+// need an agent and is meant for local development and CI.
+type JSONRecorder struct {
+	sync.Mutex
+	w      io.Writer
+	pretty bool
+
+	// set for file backed recorders only
+	file     *os.File
+	path     string
+	maxBytes int64
+	size     int64
+}
+
+// NewJSONRecorder returns a recorder writing spans to w.
+func NewJSONRecorder(w io.Writer, pretty bool) *JSONRecorder {
+	return &JSONRecorder{w: w, pretty: pretty}
+}
+
+// NewJSONFileRecorder returns a recorder appending spans to the file at
+// path. Once the file would grow past maxBytes it is rotated to path.1,
+// path.1 to path.2 and so on. A maxBytes of zero disables rotation.
+func NewJSONFileRecorder(path string, maxBytes int64, pretty bool) (*JSONRecorder, error) {
+	r := &JSONRecorder{pretty: pretty, path: path, maxBytes: maxBytes}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *JSONRecorder) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.file = f
+	r.w = f
+	r.size = fi.Size()
+
+	return nil
+}
+
+// rotate moves the current file out of the way and starts a new one. If
+// the file can't be moved, writing continues at its end.
+func (r *JSONRecorder) rotate() error {
+	r.file.Close()
+	r.file, r.w = nil, nil
+
+	for i := jsonRecorderBackups - 1; i > 0; i-- {
+		os.Rename(r.backupPath(i), r.backupPath(i+1))
+	}
+
+	err := os.Rename(r.path, r.backupPath(1))
+	if oerr := r.open(); err == nil {
+		err = oerr
+	}
+
+	return err
+}
+
+func (r *JSONRecorder) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", filepath.Clean(r.path), n)
+}
+
+// RecordSpan writes the span.
+func (r *JSONRecorder) RecordSpan(span *spanS) {
+	serviceName := filepath.Base(os.Args[0])
+	var from *fromS
+	if sensor != nil {
+		serviceName = sensor.serviceName
+		from = sensor.agent.getFrom()
+	}
+
+	js := newJSONSpan(span, serviceName)
+	js.From = from
+
+	var b []byte
+	var err error
+	if r.pretty {
+		b, err = json.MarshalIndent(js, "", "  ")
+	} else {
+		b, err = json.Marshal(js)
+	}
+
+	if err != nil {
+		r.logError("Cannot serialize span:", err)
+		return
+	}
+	b = append(b, '\n')
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.file != nil && r.maxBytes > 0 && r.size > 0 && r.size+int64(len(b)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			r.logError("Cannot rotate span file:", err)
+		}
+	}
+
+	if r.w == nil {
+		// closed
+		return
+	}
+
+	n, err := r.w.Write(b)
+	r.size += int64(n)
+	if err != nil {
+		r.logError("Cannot write span:", err)
+	}
+}
+
+// logError reports errors through the sensor log, or the standard logger
+// if the recorder is used without a sensor.
+func (r *JSONRecorder) logError(v ...interface{}) {
+	if log == nil {
+		l.Println(append([]interface{}{"ERROR: instana:"}, v...)...)
+		return
+	}
+
+	log.error(v...)
+}
+
+// Close closes the file of a file backed recorder.
+func (r *JSONRecorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+	r.w = nil
+
+	return err
+}
@@ -0,0 +1,129 @@
+package instana_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/instana/golang-sensor"
+	ext "github.com/opentracing/opentracing-go/ext"
+	"github.com/stretchr/testify/assert"
+)
+
+type wireSpan struct {
+	TraceID  int64  `json:"t"`
+	ParentID *int64 `json:"p"`
+	SpanID   int64  `json:"s"`
+	Name     string `json:"n"`
+	Lang     string `json:"ta"`
+	Data     struct {
+		Service string `json:"service"`
+		SDK     struct {
+			Name   string `json:"name"`
+			Type   string `json:"type"`
+			Custom struct {
+				Tags map[string]interface{} `json:"tags"`
+			} `json:"custom"`
+		} `json:"sdk"`
+	} `json:"data"`
+}
+
+func TestJSONRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	opts := instana.Options{LogLevel: instana.Debug}
+	tracer := instana.NewTracerWithEverything(&opts, instana.NewJSONRecorder(&buf, false))
+
+	parent := tracer.StartSpan("parent")
+	parent.SetTag(string(ext.SpanKind), "entry")
+	child := tracer.StartSpan("child", ext.RPCServerOption(parent.Context()))
+	child.SetTag("foo", "bar")
+	child.Finish()
+	parent.Finish()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines), "Each span should be written as a line")
+
+	var spans []wireSpan
+	for _, line := range lines {
+		var span wireSpan
+		assert.NoError(t, json.Unmarshal([]byte(line), &span))
+		spans = append(spans, span)
+	}
+
+	assert.Equal(t, "child", spans[0].Data.SDK.Name)
+	assert.Equal(t, "bar", spans[0].Data.SDK.Custom.Tags["foo"])
+	assert.Equal(t, spans[1].SpanID, *spans[0].ParentID)
+	assert.Equal(t, "parent", spans[1].Data.SDK.Name)
+	assert.Equal(t, "entry", spans[1].Data.SDK.Type)
+	assert.Nil(t, spans[1].ParentID)
+	assert.Equal(t, "sdk", spans[1].Name)
+	assert.Equal(t, "go", spans[1].Lang)
+}
+
+func TestJSONRecorderPretty(t *testing.T) {
+	var buf bytes.Buffer
+	opts := instana.Options{LogLevel: instana.Debug}
+	tracer := instana.NewTracerWithEverything(&opts, instana.NewJSONRecorder(&buf, true))
+
+	tracer.StartSpan("first").Finish()
+	tracer.StartSpan("second").Finish()
+
+	assert.Contains(t, buf.String(), "\n  \"t\": ", "Pretty output should be indented")
+
+	dec := json.NewDecoder(&buf)
+	var names []string
+	for dec.More() {
+		var span wireSpan
+		assert.NoError(t, dec.Decode(&span))
+		names = append(names, span.Data.SDK.Name)
+	}
+	assert.Equal(t, []string{"first", "second"}, names)
+}
+
+func TestJSONFileRecorderRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instana-json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "spans.jsonl")
+	recorder, err := instana.NewJSONFileRecorder(path, 600, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := instana.Options{LogLevel: instana.Debug}
+	tracer := instana.NewTracerWithEverything(&opts, recorder)
+	for i := 0; i < 20; i++ {
+		tracer.StartSpan("rotated").Finish()
+	}
+	assert.NoError(t, recorder.Close())
+
+	total := 0
+	for _, name := range []string{path, path + ".1", path + ".2", path + ".3"} {
+		fi, err := os.Stat(name)
+		if !assert.NoError(t, err, "Missing file %s", name) {
+			continue
+		}
+		assert.True(t, fi.Size() <= 600, "%s exceeds the size limit", name)
+
+		f, _ := os.Open(name)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var span wireSpan
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &span), "Rotation should not split lines")
+			total++
+		}
+		f.Close()
+	}
+
+	_, err = os.Stat(path + ".4")
+	assert.True(t, os.IsNotExist(err), "Only three backups should be kept")
+	assert.True(t, total > 0 && total < 20, "The oldest spans should have been rotated away")
+}
@@ -1,6 +1,8 @@
 package instana
 
 import (
+	"time"
+
 	ot "github.com/opentracing/opentracing-go"
 )
 
@@ -16,6 +18,9 @@ type jsonSpan struct {
 	Ec        int       `json:"ec,omitempty"`
 	Lang      string    `json:"ta,omitempty"`
 	Data      *jsonData `json:"data"`
+
+	// encoded is the span serialized by splitBatch, reused when posting
+	encoded []byte
 }
 
 type jsonData struct {
@@ -36,3 +41,47 @@ type jsonSDKData struct {
 	Return    string          `json:"return,omitempty"`
 	Custom    *jsonCustomData `json:"custom,omitempty"`
 }
+
+// newJSONSpan converts a finished span into the format sent to the agent.
+// The from info is left for the caller to fill in.
+func newJSONSpan(span *spanS, serviceName string) jsonSpan {
+	var data = &jsonData{}
+	kind := span.getSpanKind()
+
+	data.SDK = &jsonSDKData{
+		Name:   span.Operation,
+		Type:   kind,
+		Custom: &jsonCustomData{Tags: span.Tags, Logs: span.collectLogs()}}
+
+	baggage := make(map[string]string)
+	span.context.ForeachBaggageItem(func(k string, v string) bool {
+		baggage[k] = v
+
+		return true
+	})
+
+	if len(baggage) > 0 {
+		data.SDK.Custom.Baggage = baggage
+	}
+
+	data.Service = serviceName
+
+	var parentID *int64
+	if span.ParentSpanID == 0 {
+		parentID = nil
+	} else {
+		parentID = &span.ParentSpanID
+	}
+
+	return jsonSpan{
+		TraceID:   span.context.TraceID,
+		ParentID:  parentID,
+		SpanID:    span.context.SpanID,
+		Timestamp: uint64(span.Start.UnixNano()) / uint64(time.Millisecond),
+		Duration:  uint64(span.Duration) / uint64(time.Millisecond),
+		Name:      "sdk",
+		Error:     span.Error,
+		Ec:        span.Ec,
+		Lang:      "go",
+		Data:      data}
+}
@@ -2,6 +2,7 @@ package instana
 
 import (
 	l "log"
+	"sync/atomic"
 )
 
 // Valid log levels
@@ -14,6 +15,9 @@ const (
 
 type logS struct {
 	sensor *sensorS
+	// set when the level is changed at runtime, overrides the LogLevel
+	// option
+	level atomic.Value
 }
 
 var log *logS
@@ -22,26 +26,39 @@ func (r *logS) makeV(prefix string, v ...interface{}) []interface{} {
 	return append([]interface{}{prefix}, v...)
 }
 
+func (r *logS) getLevel() int {
+	if level, ok := r.level.Load().(int); ok {
+		return level
+	}
+
+	return r.sensor.options.LogLevel
+}
+
+// setLevel changes the log level of the running sensor.
+func (r *logS) setLevel(level int) {
+	r.level.Store(level)
+}
+
 func (r *logS) debug(v ...interface{}) {
-	if r.sensor.options.LogLevel >= Debug {
+	if r.getLevel() >= Debug {
 		l.Println(r.makeV("DEBUG: instana:", v...)...)
 	}
 }
 
 func (r *logS) info(v ...interface{}) {
-	if r.sensor.options.LogLevel >= Info {
+	if r.getLevel() >= Info {
 		l.Println(r.makeV("INFO: instana:", v...)...)
 	}
 }
 
 func (r *logS) warn(v ...interface{}) {
-	if r.sensor.options.LogLevel >= Warn {
+	if r.getLevel() >= Warn {
 		l.Println(r.makeV("WARN: instana:", v...)...)
 	}
 }
 
 func (r *logS) error(v ...interface{}) {
-	if r.sensor.options.LogLevel >= Error {
+	if r.getLevel() >= Error {
 		l.Println(r.makeV("ERROR: instana:", v...)...)
 	}
 }
@@ -3,11 +3,12 @@ package instana
 import (
 	"runtime"
 	"strconv"
-	"time"
+	"sync"
 )
 
 const (
-	// SnapshotPeriod is the amount of time in seconds between snapshot reports.
+	// SnapshotPeriod is the default amount of time in seconds between
+	// snapshot reports, see Options.SnapshotInterval.
 	SnapshotPeriod = 600
 )
 
@@ -58,44 +59,102 @@ type EntityData struct {
 type meterS struct {
 	sensor            *sensorS
 	numGC             uint32
-	ticker            *time.Ticker
 	snapshotCountdown int
+
+	// pending holds the report waiting for the sender
+	pending  chan *EntityData
+	stopCh   chan struct{}
+	stopOnce sync.Once
 }
 
 func (r *meterS) init() {
-	r.ticker = time.NewTicker(1 * time.Second)
+	r.snapshotCountdown = 1
+	r.pending = make(chan *EntityData, 1)
+	r.stopCh = make(chan struct{})
+	go r.sendLoop()
 	go func() {
-		r.snapshotCountdown = 1
-		for range r.ticker.C {
-			if r.sensor.agent.canSend() {
-				r.snapshotCountdown--
-				var s *SnapshotS
-				if r.snapshotCountdown == 0 {
-					r.snapshotCountdown = SnapshotPeriod
-					s = r.collectSnapshot()
-					log.debug("collected snapshot")
-				} else {
-					s = nil
-				}
-
-				pid, _ := strconv.Atoi(r.sensor.agent.from.PID)
-				d := &EntityData{
-					PID:      pid,
-					Snapshot: s,
-					Metrics:  r.collectMetrics()}
-
-				go r.send(d)
+		// the sender ends once the pending report is sent
+		defer close(r.pending)
+
+		for {
+			timer := r.sensor.getClock().NewTimer(r.sensor.options.MetricsInterval)
+			select {
+			case <-timer.C():
+				r.tick()
+			case <-r.stopCh:
+				timer.Stop()
+				return
 			}
 		}
 	}()
 }
 
-func (r *meterS) send(d *EntityData) {
-	_, err := r.sensor.agent.request(r.sensor.agent.makeURL(agentDataURL), "POST", d)
+// stop ends sending metrics.
+func (r *meterS) stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopCh)
+	})
+}
+
+// tick sends the metrics to the agent, along with the snapshot once every
+// SnapshotInterval.
+func (r *meterS) tick() {
+	if !r.sensor.agent.canSend() {
+		return
+	}
+
+	r.snapshotCountdown--
+	var s *SnapshotS
+	if r.snapshotCountdown <= 0 {
+		r.snapshotCountdown = int(r.sensor.options.SnapshotInterval / r.sensor.options.MetricsInterval)
+		s = r.collectSnapshot()
+		log.debug("collected snapshot")
+	}
+
+	pid, _ := strconv.Atoi(r.sensor.agent.getFrom().PID)
+	d := &EntityData{
+		PID:      pid,
+		Snapshot: s,
+		Metrics:  r.collectMetrics()}
+
+	r.queue(d)
+}
 
-	if err != nil {
-		r.sensor.agent.reset()
+// queue hands a report to the sender. While the sender is busy with a
+// slow agent, a newer report replaces the one still waiting, keeping its
+// snapshot, so reports never pile up.
+func (r *meterS) queue(d *EntityData) {
+	select {
+	case r.pending <- d:
+		return
+	default:
 	}
+
+	select {
+	case old := <-r.pending:
+		log.debug("agent is slow, replacing pending metrics")
+		if d.Snapshot == nil {
+			d.Snapshot = old.Snapshot
+		}
+	default:
+		// picked up by the sender in the meantime
+	}
+
+	r.pending <- d
+}
+
+// sendLoop posts the reports to the agent one at a time.
+func (r *meterS) sendLoop() {
+	for d := range r.pending {
+		r.send(d)
+	}
+}
+
+func (r *meterS) send(d *EntityData) {
+	r.sensor.agent.sendWithRetry(func() error {
+		_, err := r.sensor.agent.request(r.sensor.agent.makeURL(agentDataURL), "POST", d)
+		return err
+	})
 }
 
 func (r *meterS) collectMemoryMetrics() *MemoryS {
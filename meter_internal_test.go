@@ -0,0 +1,82 @@
+package instana
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeterSendsOneReportAtATime(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	var reports []EntityData
+
+	received := make(chan struct{}, 10)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var d EntityData
+		json.NewDecoder(req.Body).Decode(&d)
+
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		reports = append(reports, d)
+		mu.Unlock()
+
+		received <- struct{}{}
+		<-release
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{MetricsInterval: time.Second, SnapshotInterval: time.Minute})
+	agent.sensor.clock = newFakeClock()
+	useTestServer(t, agent, srv)
+
+	meter := &meterS{sensor: agent.sensor}
+	meter.init()
+
+	meter.tick()
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Metrics were not sent")
+	}
+
+	// the agent stalls on the first report
+	for i := 0; i < 20; i++ {
+		meter.tick()
+	}
+	close(release)
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pending metrics were not sent")
+	}
+
+	select {
+	case <-received:
+		t.Fatal("Reports made while the agent stalled should replace each other")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, 1, maxInFlight, "Metrics should be posted one at a time")
+	if assert.Len(t, reports, 2) {
+		assert.NotNil(t, reports[0].Snapshot)
+		assert.Nil(t, reports[1].Snapshot)
+	}
+}
@@ -0,0 +1,91 @@
+package instana
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// multiRecorderQueueSize is the number of spans a recorder of a
+// MultiRecorder may fall behind before further spans are dropped for it.
+const multiRecorderQueueSize = 1000
+
+// MultiRecorder forwards finished spans to several recorders, for example
+// to the agent and a local debug sink at the same time. Each recorder is
+// fed from a goroutine of its own, so a slow or panicking recorder neither
+// blocks the traced code nor the other recorders.
+type MultiRecorder struct {
+	outlets   []*outletS
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+type outletS struct {
+	// accessed atomically, kept first for 64-bit alignment
+	dropped  uint64
+	recorder SpanRecorder
+	spans    chan *spanS
+}
+
+// NewMultiRecorder returns a recorder that forwards spans to all recorders.
+func NewMultiRecorder(recorders ...SpanRecorder) *MultiRecorder {
+	return newMultiRecorder(multiRecorderQueueSize, recorders...)
+}
+
+func newMultiRecorder(queueSize int, recorders ...SpanRecorder) *MultiRecorder {
+	r := &MultiRecorder{}
+	for _, recorder := range recorders {
+		o := &outletS{
+			recorder: recorder,
+			spans:    make(chan *spanS, queueSize)}
+		r.outlets = append(r.outlets, o)
+
+		r.wg.Add(1)
+		go r.forward(o)
+	}
+
+	return r
+}
+
+// RecordSpan hands a copy of the span to every recorder. If a recorder has
+// fallen too far behind, the span is dropped for that recorder only.
+func (r *MultiRecorder) RecordSpan(span *spanS) {
+	c := span.clone()
+	for _, o := range r.outlets {
+		select {
+		case o.spans <- c:
+		default:
+			if n := atomic.AddUint64(&o.dropped, 1); n%multiRecorderQueueSize == 1 {
+				log.warn("Recorder is falling behind, dropping spans. Dropped so far:", n)
+			}
+		}
+	}
+}
+
+// Close waits for the recorders to process the spans queued so far. No
+// spans must be recorded afterwards.
+func (r *MultiRecorder) Close() {
+	r.closeOnce.Do(func() {
+		for _, o := range r.outlets {
+			close(o.spans)
+		}
+		r.wg.Wait()
+	})
+}
+
+func (r *MultiRecorder) forward(o *outletS) {
+	defer r.wg.Done()
+
+	for span := range o.spans {
+		o.record(span)
+	}
+}
+
+func (o *outletS) record(span *spanS) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.error("Recorder panicked while recording span:", err)
+		}
+	}()
+
+	o.recorder.RecordSpan(span)
+}
@@ -0,0 +1,94 @@
+package instana
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type panickingRecorder struct{}
+
+func (r panickingRecorder) RecordSpan(span *spanS) {
+	panic("recorder failure")
+}
+
+type blockingRecorder struct {
+	release  chan struct{}
+	recorded *int32
+}
+
+func (r blockingRecorder) RecordSpan(span *spanS) {
+	<-r.release
+	atomic.AddInt32(r.recorded, 1)
+}
+
+func TestMultiRecorder(t *testing.T) {
+	opts := Options{LogLevel: Debug}
+	InitSensor(&opts)
+
+	first := NewTestRecorder()
+	second := NewTestRecorder()
+	multi := NewMultiRecorder(first, panickingRecorder{}, second)
+	tracer := NewTracerWithEverything(&opts, multi)
+
+	for i := 0; i < 100; i++ {
+		span := tracer.StartSpan("fan-out")
+		span.SetTag("index", i)
+		span.Finish()
+	}
+	multi.Close()
+
+	assert.Equal(t, 100, first.QueuedSpansCount(), "Spans should reach every recorder")
+	assert.Equal(t, 100, second.QueuedSpansCount(), "A panicking recorder should not affect others")
+}
+
+func TestMultiRecorderSlowRecorder(t *testing.T) {
+	opts := Options{LogLevel: Debug}
+	InitSensor(&opts)
+
+	var recorded int32
+	blocking := blockingRecorder{release: make(chan struct{}), recorded: &recorded}
+	multi := newMultiRecorder(5, blocking)
+	tracer := NewTracerWithEverything(&opts, multi)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			tracer.StartSpan("fan-out").Finish()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("A blocked recorder should not block tracing")
+	}
+
+	close(blocking.release)
+	multi.Close()
+
+	assert.True(t, atomic.LoadInt32(&recorded) <= 6, "Spans should be dropped for a recorder that falls behind")
+}
+
+func TestMultiRecorderCopiesSpans(t *testing.T) {
+	opts := Options{LogLevel: Debug}
+	InitSensor(&opts)
+
+	recorder := NewTestRecorder()
+	multi := NewMultiRecorder(recorder)
+	tracer := NewTracerWithEverything(&opts, multi)
+
+	span := tracer.StartSpan("copied")
+	span.SetTag("foo", "bar")
+	span.Finish()
+	span.SetTag("foo", "changed after finish")
+
+	multi.Close()
+
+	spans := recorder.GetQueuedSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, "bar", spans[0].Data.SDK.Custom.Tags["foo"])
+}
@@ -1,5 +1,11 @@
 package instana
 
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
 // Options allows the user to configure the to-be-initialized
 // sensor
 type Options struct {
@@ -9,4 +15,92 @@ type Options struct {
 	MaxBufferedSpans            int
 	ForceTransmissionStartingAt int
 	LogLevel                    int
+	// PreReadySpanMaxAge is how long spans finished before the agent
+	// connection is ready are kept for delivery. Defaults to
+	// DefaultPreReadySpanMaxAge, a negative value disables buffering.
+	PreReadySpanMaxAge time.Duration
+	// SpoolDir enables spooling of trace batches that could not be
+	// delivered to the agent, and of spans finished before the agent
+	// connection is ready that exceed MaxBufferedSpans. Spooled batches
+	// are replayed in order once the agent is back. Spans recorded before
+	// ready by a previous process are dropped on replay.
+	SpoolDir string
+	// SpoolMaxBytes caps the size of SpoolDir. Defaults to
+	// DefaultSpoolMaxBytes, the oldest batches are dropped first.
+	SpoolMaxBytes int64
+	// CompressionThreshold enables gzip compression of trace, metric and
+	// event payloads of at least this many bytes. Zero disables it.
+	CompressionThreshold int
+	// MaxSpansPerBatch and MaxBatchBytes limit the number of spans and
+	// the serialized size of a single trace post to the agent. Default to
+	// DefaultMaxSpansPerBatch and DefaultMaxBatchBytes.
+	MaxSpansPerBatch int
+	MaxBatchBytes    int
+	// EndpointURL enables agentless mode: spans, metrics and events are
+	// sent straight to the backend acceptor at this URL, authenticated
+	// with AgentKey, instead of to a host agent. Without an AgentKey the
+	// EndpointURL is ignored.
+	EndpointURL string
+	AgentKey    string
+	// FlushInterval is how often queued spans are sent to the agent.
+	// Defaults to DefaultFlushInterval.
+	FlushInterval time.Duration
+	// MetricsInterval is how often runtime metrics are sent to the agent,
+	// SnapshotInterval how often the snapshot is sent along with them.
+	// Default to DefaultMetricsInterval and DefaultSnapshotInterval.
+	MetricsInterval  time.Duration
+	SnapshotInterval time.Duration
+	// AgentRetryPeriod is the delay before a failed agent lookup, announce
+	// or test is retried. After AgentMaxRetries failed announce or test
+	// attempts the sensor starts over with the lookup. Default to
+	// DefaultAgentRetryPeriod and DefaultAgentMaxRetries.
+	AgentRetryPeriod time.Duration
+	AgentMaxRetries  int
+	// AgentDiscovery is the ordered list of sources of hosts the agent
+	// is looked up at. All hosts are probed at once, the first one in
+	// order that answers is used. Defaults to AgentHost, or else
+	// INSTANA_AGENT_HOST, or else localhost, and the default gateway.
+	AgentDiscovery []AgentDiscoverySource
+	// SecretsMatcher and SecretsList configure which keys, such as header
+	// names, hold secrets that are masked. SecretsMatcher is one of the
+	// Secrets* matchers. If unset, the configuration of the agent is used
+	// and DefaultSecretsMatcher for key, pass and secret without an agent.
+	SecretsMatcher string
+	SecretsList    []string
+	// DisableTracing drops all spans. The agent can disable tracing as
+	// well, false leaves the decision to the agent and cannot re-enable
+	// tracing the agent disabled.
+	DisableTracing bool
+	// SamplingRate is the share of traces that are recorded, between 0
+	// and 1. If 0, the sampling rate of the agent is used, all traces
+	// are recorded without one. A local rate of 0 is therefore the same as
+	// unset; use DisableTracing to drop all spans.
+	SamplingRate float64
+	// ExtraHTTPHeaders are the HTTP headers TagHTTPHeaders records on
+	// spans. If unset, the headers configured in the agent are used.
+	ExtraHTTPHeaders []string
+	// AgentScheme is http or https, the scheme the agent is talked to
+	// with. Defaults to DefaultAgentScheme.
+	AgentScheme string
+	// AgentSocket is the path of a Unix domain socket the agent is talked
+	// to through instead of TCP, e.g. unix:///var/run/instana/agent.sock.
+	// Agent discovery is skipped then. Ignored if AgentTransport is set.
+	AgentSocket string
+	// AgentTLSConfig and AgentProxyURL configure the TLS connection to
+	// the agent and the HTTP proxy it is reached through. Without a proxy
+	// URL the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	// apply.
+	AgentTLSConfig *tls.Config
+	AgentProxyURL  string
+	// AgentTransport replaces the transport requests to the agent are sent
+	// with, AgentSocket, AgentTLSConfig and AgentProxyURL are ignored
+	// then.
+	AgentTransport http.RoundTripper
+	// AgentTimeout limits the time of a request to the agent. Defaults to
+	// DefaultAgentTimeout.
+	AgentTimeout time.Duration
+	// AgentRequestsInterval is how often the agent is asked for actions
+	// to run, see RegisterAgentAction. Defaults to
+	// DefaultAgentRequestsInterval.
+	AgentRequestsInterval time.Duration
 }
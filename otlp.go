@@ -0,0 +1,246 @@
+package instana
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// OTLP span kinds
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpSpanKindClient   = 3
+	otlpSpanKindProducer = 4
+	otlpSpanKindConsumer = 5
+)
+
+// OTLP status codes
+const (
+	otlpStatusUnset = 0
+	otlpStatusError = 2
+)
+
+const otlpScopeName = "github.com/instana/golang-sensor"
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// otlpAnyValue holds exactly one of its fields. 64-bit integers are
+// encoded as strings in OTLP JSON.
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// OTLPRecorder exports finished spans as OTLP/HTTP JSON trace requests to an
+// OpenTelemetry Collector, for example next to the Recorder through a
+// MultiRecorder while migrating.
+type OTLPRecorder struct {
+	exporter *exporterS
+}
+
+// NewOTLPRecorder returns a recorder posting spans to the OTLP/HTTP traces
+// endpoint at url, usually http://<collector>:4318/v1/traces.
+func NewOTLPRecorder(url string) *OTLPRecorder {
+	return &OTLPRecorder{exporter: newExporter(url, encodeOTLPRequest)}
+}
+
+// RecordSpan queues the span for export.
+func (r *OTLPRecorder) RecordSpan(span *spanS) {
+	r.exporter.add(newOTLPSpan(span))
+}
+
+// Close exports the queued spans and stops the recorder.
+func (r *OTLPRecorder) Close() {
+	r.exporter.close()
+}
+
+func encodeOTLPRequest(batch []interface{}) interface{} {
+	spans := make([]otlpSpan, len(batch))
+	for i, span := range batch {
+		spans[i] = span.(otlpSpan)
+	}
+
+	serviceName := filepath.Base(os.Args[0])
+	if sensor != nil {
+		serviceName = sensor.serviceName
+	}
+
+	return otlpTraceRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			otlpAttribute("service.name", serviceName),
+			otlpAttribute("telemetry.sdk.language", "go"),
+			otlpAttribute("process.pid", os.Getpid())}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: otlpScopeName},
+			Spans: spans}}}}}
+}
+
+func newOTLPSpan(span *spanS) otlpSpan {
+	ret := otlpSpan{
+		TraceID:           otlpID(span.context.TraceID, 32),
+		SpanID:            otlpID(span.context.SpanID, 16),
+		Name:              span.Operation,
+		Kind:              otlpSpanKind(span),
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.Start.Add(span.Duration).UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusUnset}}
+
+	if span.ParentSpanID != 0 {
+		ret.ParentSpanID = otlpID(span.ParentSpanID, 16)
+	}
+
+	if span.Error {
+		ret.Status.Code = otlpStatusError
+	}
+
+	keys := make([]string, 0, len(span.Tags))
+	for k := range span.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		ret.Attributes = append(ret.Attributes, otlpAttribute(k, span.Tags[k]))
+	}
+
+	span.context.ForeachBaggageItem(func(k string, v string) bool {
+		ret.Attributes = append(ret.Attributes, otlpAttribute("baggage."+k, v))
+		return true
+	})
+
+	for _, l := range span.Logs {
+		ret.Events = append(ret.Events, newOTLPEvent(l))
+	}
+
+	return ret
+}
+
+// newOTLPEvent turns a span log into a span event named after its event
+// field, all other fields become attributes.
+func newOTLPEvent(l ot.LogRecord) otlpEvent {
+	event := otlpEvent{
+		TimeUnixNano: strconv.FormatInt(l.Timestamp.UnixNano(), 10),
+		Name:         "log"}
+
+	for _, f := range l.Fields {
+		if f.Key() == "event" {
+			if name, ok := f.Value().(string); ok {
+				event.Name = name
+				continue
+			}
+		}
+
+		event.Attributes = append(event.Attributes, otlpAttribute(f.Key(), f.Value()))
+	}
+
+	return event
+}
+
+// otlpID renders an Instana ID as the zero padded hex string OTLP expects.
+func otlpID(id int64, length int) string {
+	return fmt.Sprintf("%0*x", length, uint64(id))
+}
+
+// otlpSpanKind maps the span kind onto the OTLP one. Instana only knows
+// entries and exits, so producer and consumer are taken from the tag.
+func otlpSpanKind(span *spanS) int {
+	switch span.getStringTag(string(ext.SpanKind)) {
+	case string(ext.SpanKindProducerEnum):
+		return otlpSpanKindProducer
+	case string(ext.SpanKindConsumerEnum):
+		return otlpSpanKindConsumer
+	}
+
+	switch span.getSpanKind() {
+	case "entry":
+		return otlpSpanKindServer
+	case "exit":
+		return otlpSpanKindClient
+	}
+
+	return otlpSpanKindInternal
+}
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	var v otlpAnyValue
+
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case bool:
+		v.BoolValue = &value
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		s := fmt.Sprint(value)
+		v.IntValue = &s
+	case float32:
+		f := float64(value)
+		v.DoubleValue = &f
+	case float64:
+		v.DoubleValue = &value
+	case time.Duration:
+		s := strconv.FormatInt(int64(value), 10)
+		v.IntValue = &s
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+
+	return otlpKeyValue{Key: key, Value: v}
+}
@@ -0,0 +1,99 @@
+package instana
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOTLPID(t *testing.T) {
+	assert.Equal(t, "0000000000000000000000000000002a", otlpID(42, 32))
+	assert.Equal(t, "938a406416457535", otlpID(-7815363404733516491, 16))
+}
+
+func TestOTLPAttribute(t *testing.T) {
+	str, num, float, flag := "value", "42", 2.5, true
+
+	assert.Equal(t, otlpAnyValue{StringValue: &str}, otlpAttribute("k", "value").Value)
+	assert.Equal(t, otlpAnyValue{IntValue: &num}, otlpAttribute("k", 42).Value)
+	assert.Equal(t, otlpAnyValue{IntValue: &num}, otlpAttribute("k", uint16(42)).Value)
+	assert.Equal(t, otlpAnyValue{DoubleValue: &float}, otlpAttribute("k", 2.5).Value)
+	assert.Equal(t, otlpAnyValue{BoolValue: &flag}, otlpAttribute("k", true).Value)
+	assert.Equal(t, otlpAnyValue{StringValue: &num}, otlpAttribute("k", errors.New("42")).Value)
+}
+
+func TestOTLPRecorder(t *testing.T) {
+	var mu sync.Mutex
+	var requests []otlpTraceRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+
+		var r otlpTraceRequest
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&r))
+
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	opts := Options{Service: "otlp-test", LogLevel: Debug}
+	recorder := NewOTLPRecorder(srv.URL + "/v1/traces")
+	tracer := NewTracerWithEverything(&opts, recorder)
+
+	parent := tracer.StartSpan("parent")
+	parent.SetTag(string(ext.SpanKind), "entry")
+	parent.SetBaggageItem("tenant", "acme")
+
+	child := tracer.StartSpan("child", ot.ChildOf(parent.Context()))
+	ext.SpanKindProducer.Set(child)
+	child.SetTag("queue", "orders")
+	child.LogFields(otlog.String("event", "retry"), otlog.Int("attempt", 2))
+	child.SetTag("error", true)
+	child.Finish()
+	parent.Finish()
+
+	recorder.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !assert.Equal(t, 1, len(requests)) {
+		return
+	}
+
+	rs := requests[0].ResourceSpans[0]
+	assert.Equal(t, otlpAttribute("service.name", sensor.serviceName), rs.Resource.Attributes[0])
+	assert.Equal(t, otlpScopeName, rs.ScopeSpans[0].Scope.Name)
+
+	spans := rs.ScopeSpans[0].Spans
+	assert.Equal(t, 2, len(spans))
+	c, p := spans[0], spans[1]
+
+	assert.Equal(t, "parent", p.Name)
+	assert.Equal(t, otlpSpanKindServer, p.Kind)
+	assert.Equal(t, "", p.ParentSpanID)
+	assert.Contains(t, p.Attributes, otlpAttribute("baggage.tenant", "acme"))
+	assert.Equal(t, otlpStatusUnset, p.Status.Code)
+
+	assert.Equal(t, "child", c.Name)
+	assert.Equal(t, otlpSpanKindProducer, c.Kind)
+	assert.Equal(t, p.TraceID, c.TraceID)
+	assert.Equal(t, p.SpanID, c.ParentSpanID)
+	assert.Equal(t, 32, len(c.TraceID))
+	assert.Contains(t, c.Attributes, otlpAttribute("queue", "orders"))
+	assert.Contains(t, c.Attributes, otlpAttribute("baggage.tenant", "acme"))
+	assert.Equal(t, otlpStatusError, c.Status.Code)
+
+	if assert.Equal(t, 1, len(c.Events)) {
+		assert.Equal(t, "retry", c.Events[0].Name)
+		assert.Equal(t, []otlpKeyValue{otlpAttribute("attempt", 2)}, c.Events[0].Attributes)
+	}
+}
@@ -0,0 +1,49 @@
+package instana
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// the PID in the first line of /proc/<pid>/sched
+var schedPID = regexp.MustCompile(`\((\d+),`)
+
+// schedFilePID returns the PID from the sched file at path, zero if it
+// can't be read.
+func schedFilePID(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	pid, err := parseSchedPID(f)
+	if err != nil {
+		log.debug("cannot parse", path, err)
+		return 0
+	}
+
+	return pid
+}
+
+// parseSchedPID reads the PID from the first line of /proc/<pid>/sched,
+// e.g. "app (1234, #threads: 5)". Inside a PID namespace it is the PID of
+// the process on the host.
+func parseSchedPID(r io.Reader) (int, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	match := schedPID.FindStringSubmatch(line)
+	if match == nil {
+		return 0, fmt.Errorf("no PID in %q", strings.TrimSpace(line))
+	}
+
+	return strconv.Atoi(match[1])
+}
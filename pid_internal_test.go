@@ -0,0 +1,28 @@
+package instana
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSchedPID(t *testing.T) {
+	pid, err := parseSchedPID(strings.NewReader("app (4321, #threads: 7)\n---\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4321, pid)
+
+	for _, text := range []string{"", "app\n---\n", "app (, #threads: 7)\n"} {
+		_, err := parseSchedPID(strings.NewReader(text))
+		assert.Error(t, err, "%q", text)
+	}
+}
+
+func TestSchedFilePID(t *testing.T) {
+	InitSensor(&Options{LogLevel: Error})
+
+	assert.Equal(t, 4321, schedFilePID("testdata/sched/host-pid"))
+	assert.Equal(t, 0, schedFilePID("testdata/sched/no-pid"))
+	assert.Equal(t, 0, schedFilePID("testdata/sched/empty"))
+	assert.Equal(t, 0, schedFilePID("testdata/sched/missing"))
+}
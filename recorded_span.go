@@ -0,0 +1,261 @@
+package instana
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// RecordedSpan is a read-only view of a finished span as it is queued for
+// the agent. It is meant for inspecting recorded spans in tests and tools.
+type RecordedSpan struct {
+	span jsonSpan
+}
+
+// RecordedLog is a log entry of a recorded span.
+type RecordedLog struct {
+	Timestamp time.Time
+	Fields    map[string]interface{}
+}
+
+// TraceID returns the ID of the trace the span belongs to.
+func (s RecordedSpan) TraceID() int64 {
+	return s.span.TraceID
+}
+
+// SpanID returns the ID of the span.
+func (s RecordedSpan) SpanID() int64 {
+	return s.span.SpanID
+}
+
+// ParentID returns the ID of the parent span, ok is false for root spans.
+func (s RecordedSpan) ParentID() (id int64, ok bool) {
+	if s.span.ParentID == nil {
+		return 0, false
+	}
+
+	return *s.span.ParentID, true
+}
+
+// IsRoot tells whether the span has no parent.
+func (s RecordedSpan) IsRoot() bool {
+	return s.span.ParentID == nil
+}
+
+// Operation returns the operation name of the span.
+func (s RecordedSpan) Operation() string {
+	if sdk := s.sdk(); sdk != nil {
+		return sdk.Name
+	}
+
+	return ""
+}
+
+// Kind returns "entry", "exit" or an empty string for local spans.
+func (s RecordedSpan) Kind() string {
+	if sdk := s.sdk(); sdk != nil {
+		return sdk.Type
+	}
+
+	return ""
+}
+
+// Service returns the name of the service that recorded the span.
+func (s RecordedSpan) Service() string {
+	if s.span.Data == nil {
+		return ""
+	}
+
+	return s.span.Data.Service
+}
+
+// Timestamp returns the start time of the span, at millisecond precision.
+func (s RecordedSpan) Timestamp() time.Time {
+	ms := int64(s.span.Timestamp)
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+// Duration returns the duration of the span, at millisecond precision.
+func (s RecordedSpan) Duration() time.Duration {
+	return time.Duration(s.span.Duration) * time.Millisecond
+}
+
+// Errored tells whether an error was tagged or logged on the span.
+func (s RecordedSpan) Errored() bool {
+	return s.span.Error
+}
+
+// ErrorCount returns the number of errors tagged or logged on the span.
+func (s RecordedSpan) ErrorCount() int {
+	return s.span.Ec
+}
+
+// Tags returns a copy of the tags of the span.
+func (s RecordedSpan) Tags() map[string]interface{} {
+	tags := make(map[string]interface{})
+	if custom := s.custom(); custom != nil {
+		for k, v := range custom.Tags {
+			tags[k] = v
+		}
+	}
+
+	return tags
+}
+
+// Tag returns the value of a single tag.
+func (s RecordedSpan) Tag(key string) (value interface{}, ok bool) {
+	if custom := s.custom(); custom != nil {
+		value, ok = custom.Tags[key]
+	}
+
+	return value, ok
+}
+
+// Logs returns the logs of the span, oldest first. Fields logged within
+// the same millisecond are merged into one entry.
+func (s RecordedSpan) Logs() []RecordedLog {
+	custom := s.custom()
+	if custom == nil {
+		return nil
+	}
+
+	var logs []RecordedLog
+	for ts, fields := range custom.Logs {
+		l := RecordedLog{
+			Timestamp: time.Unix(int64(ts/1000), int64(ts%1000)*int64(time.Millisecond)),
+			Fields:    make(map[string]interface{}, len(fields))}
+		for k, v := range fields {
+			l.Fields[k] = v
+		}
+		logs = append(logs, l)
+	}
+
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].Timestamp.Before(logs[j].Timestamp)
+	})
+
+	return logs
+}
+
+// Baggage returns a copy of the baggage items of the span.
+func (s RecordedSpan) Baggage() map[string]string {
+	baggage := make(map[string]string)
+	if custom := s.custom(); custom != nil {
+		for k, v := range custom.Baggage {
+			baggage[k] = v
+		}
+	}
+
+	return baggage
+}
+
+// MarshalJSON encodes the span in the format sent to the agent.
+func (s RecordedSpan) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.span)
+}
+
+// UnmarshalJSON decodes a span in the format sent to the agent.
+func (s *RecordedSpan) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, &s.span)
+}
+
+func (s RecordedSpan) sdk() *jsonSDKData {
+	if s.span.Data == nil {
+		return nil
+	}
+
+	return s.span.Data.SDK
+}
+
+func (s RecordedSpan) custom() *jsonCustomData {
+	if sdk := s.sdk(); sdk != nil {
+		return sdk.Custom
+	}
+
+	return nil
+}
+
+// RecordedSpans is a list of recorded spans with helpers to query it.
+type RecordedSpans []RecordedSpan
+
+func newRecordedSpans(spans []jsonSpan) RecordedSpans {
+	ret := make(RecordedSpans, len(spans))
+	for i, span := range spans {
+		ret[i] = RecordedSpan{span: span}
+	}
+
+	return ret
+}
+
+// Filter returns the spans match returns true for.
+func (spans RecordedSpans) Filter(match func(RecordedSpan) bool) RecordedSpans {
+	var ret RecordedSpans
+	for _, span := range spans {
+		if match(span) {
+			ret = append(ret, span)
+		}
+	}
+
+	return ret
+}
+
+// WithOperation returns the spans with the given operation name.
+func (spans RecordedSpans) WithOperation(operation string) RecordedSpans {
+	return spans.Filter(func(s RecordedSpan) bool {
+		return s.Operation() == operation
+	})
+}
+
+// WithTag returns the spans with the given tag set to value.
+func (spans RecordedSpans) WithTag(key string, value interface{}) RecordedSpans {
+	return spans.Filter(func(s RecordedSpan) bool {
+		v, ok := s.Tag(key)
+		return ok && reflect.DeepEqual(v, value)
+	})
+}
+
+// WithKind returns the spans of the given kind, "entry", "exit" or an
+// empty string for local spans.
+func (spans RecordedSpans) WithKind(kind string) RecordedSpans {
+	return spans.Filter(func(s RecordedSpan) bool {
+		return s.Kind() == kind
+	})
+}
+
+// InTrace returns the spans of the given trace.
+func (spans RecordedSpans) InTrace(traceID int64) RecordedSpans {
+	return spans.Filter(func(s RecordedSpan) bool {
+		return s.TraceID() == traceID
+	})
+}
+
+// Roots returns the spans without a parent.
+func (spans RecordedSpans) Roots() RecordedSpans {
+	return spans.Filter(RecordedSpan.IsRoot)
+}
+
+// ChildrenOf returns the direct children of parent.
+func (spans RecordedSpans) ChildrenOf(parent RecordedSpan) RecordedSpans {
+	return spans.Filter(func(s RecordedSpan) bool {
+		id, ok := s.ParentID()
+		return ok && id == parent.SpanID() && s.TraceID() == parent.TraceID()
+	})
+}
+
+// ParentOf returns the parent of child, ok is false if it is a root span
+// or its parent is not in the list.
+func (spans RecordedSpans) ParentOf(child RecordedSpan) (parent RecordedSpan, ok bool) {
+	id, ok := child.ParentID()
+	if !ok {
+		return parent, false
+	}
+
+	for _, s := range spans {
+		if s.SpanID() == id && s.TraceID() == child.TraceID() {
+			return s, true
+		}
+	}
+
+	return parent, false
+}
@@ -0,0 +1,76 @@
+package instana
+
+import (
+	"testing"
+	"time"
+
+	ot "github.com/opentracing/opentracing-go"
+	ext "github.com/opentracing/opentracing-go/ext"
+	"github.com/stretchr/testify/assert"
+)
+
+// newServiceTestRecorder returns a test recorder reporting spans for
+// service, whatever the global sensor is set up with.
+func newServiceTestRecorder(service string) *Recorder {
+	InitSensor(&Options{LogLevel: Error})
+
+	s := &sensorS{}
+	s.setOptions(&Options{LogLevel: Error})
+	s.serviceName = service
+	s.agent = &agentS{sensor: s, from: &fromS{}}
+
+	r := &Recorder{sensor: s, testMode: true}
+	r.init()
+
+	return r
+}
+
+func TestRecordedSpanAccessors(t *testing.T) {
+	recorder := newServiceTestRecorder("test-service")
+	tracer := NewTracerWithEverything(&Options{LogLevel: Error}, recorder)
+
+	start := time.Now()
+	parent := tracer.StartSpan("parent", ot.StartTime(start))
+	parent.SetBaggageItem("user", "alice")
+	child := tracer.StartSpan("http-client", ot.ChildOf(parent.Context()))
+	child.SetTag(string(ext.SpanKind), "exit")
+	child.SetTag("http.status", 500)
+	child.LogKV("event", "retry")
+	ext.Error.Set(child, true)
+	child.Finish()
+	parent.FinishWithOptions(ot.FinishOptions{FinishTime: start.Add(1500 * time.Millisecond)})
+
+	spans := recorder.RecordedSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, 2, recorder.QueuedSpansCount(), "RecordedSpans does not clear the queue")
+
+	c, p := spans[0], spans[1]
+	assert.Equal(t, "http-client", c.Operation())
+	assert.Equal(t, "exit", c.Kind())
+	assert.Equal(t, "test-service", c.Service())
+	assert.Equal(t, p.TraceID(), c.TraceID())
+
+	parentID, ok := c.ParentID()
+	assert.True(t, ok)
+	assert.Equal(t, p.SpanID(), parentID)
+	assert.False(t, c.IsRoot())
+
+	status, ok := c.Tag("http.status")
+	assert.True(t, ok)
+	assert.Equal(t, 500, status)
+	assert.Equal(t, 500, c.Tags()["http.status"])
+	assert.True(t, c.Errored())
+	assert.Equal(t, 1, c.ErrorCount())
+	assert.Equal(t, "alice", c.Baggage()["user"])
+
+	logs := c.Logs()
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, "retry", logs[0].Fields["event"])
+	}
+
+	_, ok = p.ParentID()
+	assert.False(t, ok)
+	assert.Equal(t, "", p.Kind())
+	assert.Equal(t, start.Unix(), p.Timestamp().Unix())
+	assert.Equal(t, 1500*time.Millisecond, p.Duration())
+}
@@ -0,0 +1,76 @@
+package instana_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/instana/golang-sensor"
+	ot "github.com/opentracing/opentracing-go"
+	ext "github.com/opentracing/opentracing-go/ext"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordedSpansQueries(t *testing.T) {
+	opts := instana.Options{LogLevel: instana.Error}
+	recorder := instana.NewTestRecorder()
+	tracer := instana.NewTracerWithEverything(&opts, recorder)
+
+	root := tracer.StartSpan("handle")
+	root.SetTag(string(ext.SpanKind), "entry")
+	for _, table := range []string{"users", "orders"} {
+		db := tracer.StartSpan("query", ot.ChildOf(root.Context()))
+		db.SetTag(string(ext.SpanKind), "exit")
+		db.SetTag("db.table", table)
+		db.Finish()
+	}
+	root.Finish()
+
+	other := tracer.StartSpan("background")
+	other.Finish()
+
+	spans := recorder.RecordedSpans()
+	assert.Len(t, spans, 4)
+
+	assert.Len(t, spans.WithOperation("query"), 2)
+	assert.Len(t, spans.WithKind("exit"), 2)
+	assert.Len(t, spans.WithKind("entry"), 1)
+	assert.Len(t, spans.WithTag("db.table", "orders"), 1)
+	assert.Len(t, spans.WithTag("db.table", "products"), 0)
+
+	roots := spans.Roots()
+	assert.Len(t, roots, 2)
+
+	handle := spans.WithOperation("handle")[0]
+	assert.Len(t, spans.InTrace(handle.TraceID()), 3)
+
+	children := spans.ChildrenOf(handle)
+	assert.Len(t, children, 2)
+	for _, child := range children {
+		parent, ok := spans.ParentOf(child)
+		assert.True(t, ok)
+		assert.Equal(t, handle.SpanID(), parent.SpanID())
+	}
+
+	_, ok := spans.ParentOf(handle)
+	assert.False(t, ok)
+}
+
+func TestRecordedSpanJSON(t *testing.T) {
+	opts := instana.Options{LogLevel: instana.Error}
+	recorder := instana.NewTestRecorder()
+	tracer := instana.NewTracerWithEverything(&opts, recorder)
+
+	span := tracer.StartSpan("encoded")
+	span.SetTag("key", "value")
+	span.Finish()
+
+	b, err := json.Marshal(recorder.RecordedSpans())
+	assert.NoError(t, err)
+
+	var spans instana.RecordedSpans
+	assert.NoError(t, json.Unmarshal(b, &spans))
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "encoded", spans[0].Operation())
+		assert.Equal(t, "value", spans[0].Tags()["key"])
+	}
+}
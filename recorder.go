@@ -1,6 +1,7 @@
 package instana
 
 import (
+	"os"
 	"sync"
 	"time"
 )
@@ -13,12 +14,33 @@ type SpanRecorder interface {
 	RecordSpan(span *spanS)
 }
 
+// maxInFlightBatches is the number of trace batches posted to the agent
+// concurrently, and thereby the number of sender goroutines.
+const maxInFlightBatches = 2
+
+// maxOverflowBatches is the number of full pre-ready buffers waiting to be
+// spooled, further ones are dropped.
+const maxOverflowBatches = 4
+
 // Recorder accepts spans, processes and queues them
 // for delivery to the backend.
 type Recorder struct {
 	sync.RWMutex
 	spans    []jsonSpan
+	preReady []jsonSpan
 	testMode bool
+
+	// sensor the spans are reported to, the global sensor if nil
+	sensor    *sensorS
+	spool     *spoolS
+	spoolOnce sync.Once
+
+	flush    chan struct{}
+	overflow chan []jsonSpan
+	batches  chan []jsonSpan
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 }
 
 // NewRecorder Establish a Recorder span recorder
@@ -43,81 +65,245 @@ func (r *Recorder) init() {
 		return
 	}
 
-	ticker := time.NewTicker(1 * time.Second)
-	go func() {
-		for range ticker.C {
-			if sensor.agent.canSend() {
-				r.send()
-			}
+	r.flush = make(chan struct{}, 1)
+	r.overflow = make(chan []jsonSpan, maxOverflowBatches)
+	r.batches = make(chan []jsonSpan)
+	r.done = make(chan struct{})
+
+	r.wg.Add(maxInFlightBatches + 1)
+	for i := 0; i < maxInFlightBatches; i++ {
+		go r.sendLoop()
+	}
+	go r.run()
+}
+
+func (r *Recorder) getSensor() *sensorS {
+	if r.sensor != nil {
+		return r.sensor
+	}
+
+	return sensor
+}
+
+func (r *Recorder) initSpool() {
+	options := r.getSensor().options
+	if options.SpoolDir == "" {
+		return
+	}
+
+	spool, err := newSpool(options.SpoolDir, options.SpoolMaxBytes)
+	if err != nil {
+		log.error("Cannot use span spool directory:", err)
+		return
+	}
+
+	r.spool = spool
+}
+
+// run hands the queued spans to the senders every FlushInterval, or as
+// soon as the queue reaches ForceTransmissionStartingAt. While all senders
+// are busy spans keep queuing up to MaxBufferedSpans.
+func (r *Recorder) run() {
+	defer r.wg.Done()
+	defer close(r.batches)
+
+	for {
+		interval := DefaultFlushInterval
+		s := r.getSensor()
+		if s != nil {
+			interval = s.options.FlushInterval
+		}
+
+		timer := s.getClock().NewTimer(interval)
+		select {
+		case <-timer.C():
+		case <-r.flush:
+		case batch := <-r.overflow:
+			timer.Stop()
+			r.spoolOnce.Do(r.initSpool)
+			r.spoolSpans(batch)
+			continue
+		case <-r.done:
+			timer.Stop()
+			r.stop()
+			return
+		}
+		timer.Stop()
+
+		s = r.getSensor()
+		if s == nil || !s.agent.canSend() {
+			continue
 		}
-	}()
+
+		r.spoolOnce.Do(r.initSpool)
+		r.flushPreReady(s.agent.getFrom(), s.getClock().Now())
+		if !r.replaySpool() {
+			continue
+		}
+		r.send()
+	}
+}
+
+// stop hands the remaining spans to the senders, or spools them along
+// with the spans buffered before ready if the agent can't be reached at
+// the moment.
+func (r *Recorder) stop() {
+	s := r.getSensor()
+	if s == nil {
+		return
+	}
+
+	if s.agent.canSend() {
+		r.send()
+		return
+	}
+
+	r.spoolOnce.Do(r.initSpool)
+	r.spoolOverflow()
+
+	if spans := r.GetQueuedSpans(); len(spans) > 0 {
+		r.spoolSpans(spans)
+	}
+
+	r.Lock()
+	preReady := r.preReady
+	r.preReady = nil
+	r.Unlock()
+
+	if len(preReady) > 0 {
+		r.spoolSpans(preReady)
+	}
+}
+
+// Stop sends the queued spans to the agent, waits for the senders to
+// finish and stops the recorder. Spans recorded afterwards are no longer
+// sent. It stops the sensor along with it: metrics are no longer sent and
+// the agent is no longer polled for actions.
+func (r *Recorder) Stop() {
+	if r.testMode {
+		return
+	}
+
+	r.stopOnce.Do(func() {
+		close(r.done)
+		r.wg.Wait()
+
+		if s := r.getSensor(); s != nil {
+			s.stop()
+		}
+	})
 }
 
 // RecordSpan accepts spans to be recorded and and added to the span queue
 // for eventual reporting to the host agent.
 func (r *Recorder) RecordSpan(span *spanS) {
-	// If we're not announced and not in test mode then just
-	// return
+	sensor := r.getSensor()
+	if !sensor.getConfig().records(span.context.TraceID) {
+		return
+	}
+
+	js := newJSONSpan(span, sensor.serviceName)
+
+	r.Lock()
+	defer r.Unlock()
+
+	// If we're not announced and not in test mode then hold on to the
+	// span until the agent is ready; the from info isn't known yet.
 	if !r.testMode && !sensor.agent.canSend() {
+		r.bufferPreReady(js)
 		return
 	}
 
-	var data = &jsonData{}
-	kind := span.getSpanKind()
+	js.From = sensor.agent.getFrom()
+	r.enqueue(js)
 
-	data.SDK = &jsonSDKData{
-		Name:   span.Operation,
-		Type:   kind,
-		Custom: &jsonCustomData{Tags: span.Tags, Logs: span.collectLogs()}}
+	if r.testMode {
+		return
+	}
+
+	if len(r.spans) >= sensor.options.ForceTransmissionStartingAt {
+		log.debug("Forcing spans to agent.  Count:", len(r.spans))
+		select {
+		case r.flush <- struct{}{}:
+		default:
+			// a flush is already pending
+		}
+	}
+}
 
-	baggage := make(map[string]string)
-	span.context.ForeachBaggageItem(func(k string, v string) bool {
-		baggage[k] = v
+// enqueue appends a span to the send queue, dropping the oldest one
+// when the queue is full. The caller must hold the write lock.
+func (r *Recorder) enqueue(span jsonSpan) {
+	if len(r.spans) == r.getSensor().options.MaxBufferedSpans {
+		r.spans = r.spans[1:]
+	}
 
-		return true
-	})
+	r.spans = append(r.spans, span)
+}
 
-	if len(baggage) > 0 {
-		data.SDK.Custom.Baggage = baggage
+// bufferPreReady keeps a span finished before the agent connection is
+// ready. The buffer is bounded by MaxBufferedSpans. Once it is full the
+// buffered spans are handed to the run goroutine to be spooled if a spool
+// is configured, otherwise the oldest spans are dropped first. The caller
+// must hold the write lock.
+func (r *Recorder) bufferPreReady(span jsonSpan) {
+	options := r.getSensor().options
+	if options.PreReadySpanMaxAge < 0 {
+		return
 	}
 
-	data.Service = sensor.serviceName
+	if len(r.preReady) == options.MaxBufferedSpans {
+		spooled := false
+		if options.SpoolDir != "" {
+			select {
+			case r.overflow <- r.preReady:
+				spooled = true
+			default:
+				log.debug("Span spool is lagging behind, dropping pre-ready span")
+			}
+		}
 
-	var parentID *int64
-	if span.ParentSpanID == 0 {
-		parentID = nil
-	} else {
-		parentID = &span.ParentSpanID
+		if spooled {
+			r.preReady = nil
+		} else {
+			r.preReady = r.preReady[1:]
+		}
 	}
 
+	r.preReady = append(r.preReady, span)
+}
+
+// flushPreReady moves the spans buffered before the agent connection
+// became ready into the send queue and stamps them with the from info
+// resolved during announce. Spans that finished longer than
+// PreReadySpanMaxAge before now are dropped.
+func (r *Recorder) flushPreReady(from *fromS, now time.Time) {
 	r.Lock()
 	defer r.Unlock()
 
-	if len(r.spans) == sensor.options.MaxBufferedSpans {
-		r.spans = r.spans[1:]
+	if len(r.preReady) == 0 {
+		return
 	}
 
-	r.spans = append(r.spans, jsonSpan{
-		TraceID:   span.context.TraceID,
-		ParentID:  parentID,
-		SpanID:    span.context.SpanID,
-		Timestamp: uint64(span.Start.UnixNano()) / uint64(time.Millisecond),
-		Duration:  uint64(span.Duration) / uint64(time.Millisecond),
-		Name:      "sdk",
-		Error:     span.Error,
-		Ec:        span.Ec,
-		Lang:      "go",
-		From:      sensor.agent.from,
-		Data:      data})
-
-	if r.testMode || !sensor.agent.canSend() {
-		return
+	maxAge := uint64(r.getSensor().options.PreReadySpanMaxAge / time.Millisecond)
+	nowMs := uint64(now.UnixNano()) / uint64(time.Millisecond)
+
+	var dropped int
+	for _, span := range r.preReady {
+		if end := span.Timestamp + span.Duration; end+maxAge < nowMs {
+			dropped++
+			continue
+		}
+
+		span.From = from
+		r.enqueue(span)
 	}
 
-	if len(r.spans) >= sensor.options.ForceTransmissionStartingAt {
-		log.debug("Forcing spans to agent.  Count:", len(r.spans))
-		go r.send()
+	if dropped > 0 {
+		log.debug("Dropped pre-ready spans exceeding max age. Count:", dropped)
 	}
+
+	r.preReady = nil
 }
 
 // QueuedSpansCount returns the number of queued spans
@@ -128,7 +314,20 @@ func (r *Recorder) QueuedSpansCount() int {
 	return len(r.spans)
 }
 
+// RecordedSpans returns the queued spans without clearing the queue. Along
+// with NewTestRecorder it allows to inspect the spans an application
+// records in tests.
+func (r *Recorder) RecordedSpans() RecordedSpans {
+	r.RLock()
+	defer r.RUnlock()
+
+	return newRecordedSpans(r.spans)
+}
+
 // GetQueuedSpans returns a copy of the queued spans and clears the queue.
+//
+// Deprecated: the spans are of an unexported type, use RecordedSpans to
+// inspect them from outside of the package.
 func (r *Recorder) GetQueuedSpans() []jsonSpan {
 	r.Lock()
 	defer r.Unlock()
@@ -151,7 +350,7 @@ func (r *Recorder) clearQueuedSpans() {
 	var mbs int
 
 	if len(r.spans) > 0 {
-		if sensor != nil {
+		if sensor := r.getSensor(); sensor != nil {
 			mbs = sensor.options.MaxBufferedSpans
 		} else {
 			mbs = DefaultMaxBufferedSpans
@@ -160,16 +359,120 @@ func (r *Recorder) clearQueuedSpans() {
 	}
 }
 
-// Retrieve the queued spans and post them to the host agent asynchronously.
+// send splits the queued spans into batches and hands them to the
+// senders, blocking while all of them are busy.
 func (r *Recorder) send() {
 	spansToSend := r.GetQueuedSpans()
-	if len(spansToSend) > 0 {
-		go func() {
-			_, err := sensor.agent.request(sensor.agent.makeURL(agentTracesURL), "POST", spansToSend)
-			if err != nil {
-				log.debug("Posting traces failed in send(): ", err)
-				sensor.agent.reset()
+	if len(spansToSend) == 0 {
+		return
+	}
+
+	options := r.getSensor().options
+	for _, batch := range splitBatch(spansToSend, options.MaxSpansPerBatch, options.MaxBatchBytes) {
+		r.batches <- batch
+	}
+}
+
+// sendLoop posts batches to the agent until the recorder is stopped.
+func (r *Recorder) sendLoop() {
+	defer r.wg.Done()
+
+	for batch := range r.batches {
+		r.post(batch)
+	}
+}
+
+// post sends a batch to the agent, spooling whatever could not be
+// delivered.
+func (r *Recorder) post(batch []jsonSpan) {
+	agent := r.getSensor().agent
+	if !agent.canSend() {
+		// the connection was reset while the batch was waiting
+		r.spoolSpans(batch)
+		return
+	}
+
+	unsent := batch
+	err := agent.sendWithRetry(func() error {
+		var err error
+		unsent, err = agent.postSpans(unsent)
+		return err
+	})
+
+	if err != nil {
+		log.debug("Posting traces failed in send(): ", err)
+		r.spoolSpans(unsent)
+	}
+}
+
+// spoolSpans keeps a batch that could not be posted in the spool, if
+// one is configured.
+func (r *Recorder) spoolSpans(spans []jsonSpan) {
+	if r.spool == nil {
+		return
+	}
+
+	if err := r.spool.write(spans); err != nil {
+		log.error("Cannot spool traces:", err)
+	}
+}
+
+// spoolOverflow spools the full pre-ready buffers still waiting for the
+// run goroutine.
+func (r *Recorder) spoolOverflow() {
+	for {
+		select {
+		case batch := <-r.overflow:
+			r.spoolSpans(batch)
+		default:
+			return
+		}
+	}
+}
+
+// replaySpool posts the spooled batches to the agent. Spans keep the from
+// info they were recorded with, spans buffered before ready have none yet
+// and get the current one if this process recorded them, otherwise they
+// are dropped. It reports whether the spool has been drained, new spans
+// are held back until then so the order is kept.
+func (r *Recorder) replaySpool() bool {
+	if r.spool == nil {
+		return true
+	}
+
+	agent := r.getSensor().agent
+	err := r.spool.replay(func(pid int, spans []jsonSpan) ([]jsonSpan, error) {
+		var unsent []jsonSpan
+		for _, span := range spans {
+			if span.From == nil {
+				if pid != os.Getpid() {
+					continue
+				}
+				span.From = agent.getFrom()
 			}
-		}()
+			unsent = append(unsent, span)
+		}
+
+		if dropped := len(spans) - len(unsent); dropped > 0 {
+			log.debug("Dropped spooled spans of a previous process. PID:", pid, "Count:", dropped)
+		}
+		if len(unsent) == 0 {
+			return nil, nil
+		}
+
+		err := agent.sendWithRetry(func() error {
+			var err error
+			unsent, err = agent.postSpans(unsent)
+			return err
+		})
+
+		return unsent, err
+	})
+
+	if err != nil {
+		log.debug("Replaying spooled traces failed: ", err)
+		return false
 	}
+
+	return true
 }
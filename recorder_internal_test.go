@@ -1,7 +1,15 @@
 package instana
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	ext "github.com/opentracing/opentracing-go/ext"
 	"github.com/stretchr/testify/assert"
@@ -129,3 +137,243 @@ func TestGetHostName(t *testing.T) {
 	hostname := span.(*spanS).getHostName()
 	assert.True(t, len(hostname) > 0, "must return a valid string value")
 }
+
+func TestRecorderPreReadyBuffer(t *testing.T) {
+	opts := Options{LogLevel: Debug}
+
+	InitSensor(&opts)
+	recorder := &Recorder{}
+	tracer := NewTracerWithEverything(&opts, recorder)
+
+	if sensor.agent.canSend() {
+		t.Skip("agent is reachable, pre-ready buffering can't be exercised")
+	}
+
+	span := tracer.StartSpan("early")
+	span.Finish()
+
+	assert.Equal(t, 0, recorder.QueuedSpansCount(), "Spans should not be queued before ready")
+	assert.Equal(t, 1, len(recorder.preReady), "Span should be buffered until ready")
+
+	from := &fromS{PID: "42", HostID: "host"}
+	recorder.flushPreReady(from, time.Now())
+
+	spans := recorder.GetQueuedSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, from, spans[0].From, "Buffered span should be stamped with late from info")
+	assert.Equal(t, 0, len(recorder.preReady))
+}
+
+func TestRecorderPreReadyBufferMaxAge(t *testing.T) {
+	opts := Options{LogLevel: Debug}
+
+	InitSensor(&opts)
+	recorder := &Recorder{}
+	tracer := NewTracerWithEverything(&opts, recorder)
+
+	if sensor.agent.canSend() {
+		t.Skip("agent is reachable, pre-ready buffering can't be exercised")
+	}
+
+	tracer.StartSpan("stale").Finish()
+
+	recorder.flushPreReady(&fromS{}, time.Now().Add(2*sensor.options.PreReadySpanMaxAge))
+
+	assert.Equal(t, 0, recorder.QueuedSpansCount(), "Stale spans should be dropped")
+	assert.Equal(t, 0, len(recorder.preReady))
+}
+
+func newTestSpan(op string) *spanS {
+	id := randomID()
+	return &spanS{
+		context:   SpanContext{TraceID: id, SpanID: id},
+		Operation: op,
+		Start:     time.Now()}
+}
+
+func TestRecorderStopFlushesQueue(t *testing.T) {
+	var mu sync.Mutex
+	var received []jsonSpan
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var spans []jsonSpan
+		json.NewDecoder(req.Body).Decode(&spans)
+
+		mu.Lock()
+		received = append(received, spans...)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{})
+	useTestServer(t, agent, srv)
+
+	recorder := &Recorder{sensor: agent.sensor}
+	recorder.init()
+
+	for i := 0; i < 3; i++ {
+		recorder.RecordSpan(newTestSpan("queued"))
+	}
+	recorder.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 3, len(received), "Queued spans should be sent on stop")
+	assert.Equal(t, 0, recorder.QueuedSpansCount())
+}
+
+func TestRecorderBoundedInFlightBatches(t *testing.T) {
+	var inFlight, maxInFlight, posts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+
+		atomic.AddInt32(&posts, 1)
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{ForceTransmissionStartingAt: 1, MaxSpansPerBatch: 1})
+	useTestServer(t, agent, srv)
+
+	recorder := &Recorder{sensor: agent.sensor}
+	recorder.init()
+
+	for i := 0; i < 50; i++ {
+		recorder.RecordSpan(newTestSpan("forced"))
+	}
+	recorder.Stop()
+
+	assert.True(t, atomic.LoadInt32(&posts) > 0, "Spans should have been posted")
+	assert.True(t, atomic.LoadInt32(&maxInFlight) <= maxInFlightBatches,
+		"Forced transmissions should not post more than maxInFlightBatches batches at once")
+}
+
+func TestRecorderStopSpoolsWhenAgentUnavailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instana-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent := newTestAgent(&Options{SpoolDir: dir})
+	agent.reset()
+
+	recorder := &Recorder{sensor: agent.sensor}
+	recorder.init()
+	recorder.RecordSpan(newTestSpan("early"))
+	recorder.flushPreReady(agent.from, time.Now())
+	recorder.Stop()
+
+	assert.NotNil(t, recorder.spool)
+	names, _ := recorder.spool.batches()
+	assert.Equal(t, 1, len(names), "Queued spans should be spooled on stop")
+}
+
+// spooledSpanIDs replays the spool and returns the IDs of all spans in it.
+func spooledSpanIDs(t *testing.T, spool *spoolS) []int64 {
+	var ids []int64
+	err := spool.replay(func(pid int, spans []jsonSpan) ([]jsonSpan, error) {
+		for _, span := range spans {
+			ids = append(ids, span.SpanID)
+		}
+		return nil, nil
+	})
+	assert.NoError(t, err)
+
+	return ids
+}
+
+func TestRecorderSpoolsPreReadyOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instana-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent := newTestAgent(&Options{SpoolDir: dir, MaxBufferedSpans: 2})
+	agent.reset()
+
+	recorder := &Recorder{sensor: agent.sensor}
+	recorder.init()
+
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		span := newTestSpan("outage")
+		ids = append(ids, span.context.SpanID)
+		recorder.RecordSpan(span)
+	}
+
+	recorder.Lock()
+	assert.Len(t, recorder.preReady, 1, "A full pre-ready buffer should be handed over to be spooled")
+	recorder.Unlock()
+
+	recorder.Stop()
+	assert.Equal(t, ids, spooledSpanIDs(t, recorder.spool), "No span should be lost while the agent is gone")
+}
+
+func TestRecorderDropsExpiredPreReadySpansWhenSpooling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instana-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent := newTestAgent(&Options{SpoolDir: dir})
+	agent.reset()
+
+	recorder := &Recorder{sensor: agent.sensor}
+	recorder.initSpool()
+
+	span := newTestSpan("stale")
+	recorder.RecordSpan(span)
+	recorder.flushPreReady(&fromS{}, time.Now().Add(2*agent.sensor.options.PreReadySpanMaxAge))
+
+	assert.Equal(t, 0, recorder.QueuedSpansCount())
+	assert.Empty(t, spooledSpanIDs(t, recorder.spool), "Stale spans should be dropped, not spooled")
+}
+
+func TestRecorderReplayKeepsRecordedFrom(t *testing.T) {
+	var got []jsonSpan
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var spans []jsonSpan
+		json.NewDecoder(req.Body).Decode(&spans)
+		got = append(got, spans...)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "instana-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent := newTestAgent(&Options{SpoolDir: dir})
+	useTestServer(t, agent, srv)
+
+	recorder := &Recorder{sensor: agent.sensor}
+	recorder.initSpool()
+
+	// spooled by a previous process, before and after it was ready
+	previous := &fromS{PID: "41"}
+	assert.NoError(t, recorder.spool.writeFile("00000000000000000001"+spoolFileExt, spoolBatchS{
+		PID:   os.Getpid() + 1,
+		Spans: []jsonSpan{{SpanID: 1}, {SpanID: 2, From: previous}}}))
+	// spooled by this process before it was ready
+	assert.NoError(t, recorder.spool.write([]jsonSpan{{SpanID: 3}}))
+
+	assert.True(t, recorder.replaySpool())
+
+	if assert.Len(t, got, 2, "Spans of a previous process without from info should be dropped") {
+		assert.Equal(t, int64(2), got[0].SpanID)
+		assert.Equal(t, previous, got[0].From, "Spooled spans should keep their from info")
+		assert.Equal(t, int64(3), got[1].SpanID)
+		assert.Equal(t, agent.getFrom(), got[1].From)
+	}
+}
@@ -0,0 +1,115 @@
+package instana
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sendRetryInitialBackoff = 250 * time.Millisecond
+	sendRetryMaxBackoff     = 5 * time.Second
+	maximumSendRetries      = 3
+	maximumConnFailures     = 3
+)
+
+// retryPolicyS describes how often and how fast failed posts to the agent
+// are retried.
+type retryPolicyS struct {
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	retries        int
+}
+
+// backoff returns how long to wait before the given retry attempt
+// (starting at 0). The delay doubles with every attempt up to maxBackoff,
+// and a random jitter of up to half of it spreads out retries of
+// several processes hitting the same agent.
+func (r retryPolicyS) backoff(attempt int) time.Duration {
+	d := r.initialBackoff
+	for i := 0; i < attempt && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+
+	seededIDLock.Lock()
+	jitter := seededIDGen.Int63n(half + 1)
+	seededIDLock.Unlock()
+
+	return time.Duration(half + jitter)
+}
+
+// isTransientError reports whether the agent is there but could not take
+// the data at the moment, so that sending it again later may succeed.
+func isTransientError(err error) bool {
+	e, ok := err.(*agentResponseError)
+	if !ok {
+		return false
+	}
+
+	switch e.code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// sendWithRetry calls send until it succeeds or fails with an error that
+// is not transient, waiting with exponential backoff between attempts.
+// Failures that mean the agent is gone are passed on to sendFailed.
+func (r *agentS) sendWithRetry(send func() error) error {
+	err := send()
+	for attempt := 0; err != nil && isTransientError(err) && attempt < r.retryPolicy.retries; attempt++ {
+		d := r.retryPolicy.backoff(attempt)
+		log.debug("Transient agent error, retrying in", d, err)
+		<-r.sensor.getClock().NewTimer(d).C()
+
+		err = send()
+	}
+
+	if err != nil {
+		r.sendFailed(err)
+		return err
+	}
+
+	atomic.StoreInt32(&r.connFailures, 0)
+
+	return nil
+}
+
+// sendFailed resets the agent connection if a failed send means the agent
+// is gone. A 404 means the agent doesn't know this process anymore, while
+// connection failures only count once they happen several times in a row.
+func (r *agentS) sendFailed(err error) {
+	if e, ok := err.(*agentResponseError); ok {
+		// the agent answered, so it's still there
+		atomic.StoreInt32(&r.connFailures, 0)
+
+		if e.code == http.StatusNotFound {
+			log.info("Agent doesn't know this process anymore, resetting.")
+			r.reset()
+		}
+
+		return
+	}
+
+	if atomic.AddInt32(&r.connFailures, 1) >= maximumConnFailures {
+		log.info("Cannot reach the agent, resetting.", err)
+		atomic.StoreInt32(&r.connFailures, 0)
+		r.reset()
+	}
+}
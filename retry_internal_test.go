@@ -0,0 +1,152 @@
+package instana
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := retryPolicyS{initialBackoff: 100 * time.Millisecond, maxBackoff: time.Second, retries: 5}
+
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			d := policy.backoff(attempt)
+			assert.True(t, d >= max/2 && d <= max, "attempt %d: backoff %v out of [%v, %v]", attempt, d, max/2, max)
+		}
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{&agentResponseError{code: http.StatusServiceUnavailable}, true},
+		{&agentResponseError{code: http.StatusTooManyRequests}, true},
+		{&agentResponseError{code: http.StatusInternalServerError}, true},
+		{&agentResponseError{code: http.StatusNotFound}, false},
+		{&agentResponseError{code: http.StatusBadRequest}, false},
+		{errors.New("connection refused"), false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.transient, isTransientError(test.err), test.err.Error())
+	}
+}
+
+func TestSendWithRetryTransientFailure(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{})
+	err := agent.sendWithRetry(func() error {
+		_, err := agent.request(srv.URL, "POST", "data")
+		return err
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls, "Transient failures should be retried")
+	assert.True(t, agent.canSend(), "Transient failures should not reset the agent")
+}
+
+func TestSendWithRetryGivesUp(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{})
+	err := agent.sendWithRetry(func() error {
+		_, err := agent.request(srv.URL, "POST", "data")
+		return err
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, maximumSendRetries+1, calls)
+	assert.True(t, agent.canSend(), "Transient failures should not reset the agent")
+}
+
+func TestSendWithRetryAgentForgotProcess(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{})
+	err := agent.sendWithRetry(func() error {
+		_, err := agent.request(srv.URL, "POST", "data")
+		return err
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls, "404 should not be retried")
+	assert.False(t, agent.canSend(), "404 should reset the agent")
+}
+
+func TestSendWithRetryConnectionFailures(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	url := srv.URL
+	srv.Close()
+
+	agent := newTestAgent(&Options{})
+	send := func() error {
+		_, err := agent.request(url, "POST", "data")
+		return err
+	}
+
+	for i := 1; i < maximumConnFailures; i++ {
+		assert.Error(t, agent.sendWithRetry(send))
+		assert.True(t, agent.canSend(), "A single connection failure should not reset the agent")
+	}
+
+	assert.Error(t, agent.sendWithRetry(send))
+	assert.False(t, agent.canSend(), "Repeated connection failures should reset the agent")
+}
+
+func TestSendWithRetryUsesSensorClock(t *testing.T) {
+	agent := newTestAgent(&Options{})
+	agent.retryPolicy = retryPolicyS{initialBackoff: time.Minute, maxBackoff: time.Hour, retries: 2}
+
+	clock := newFakeClock()
+	agent.sensor.clock = clock
+
+	var calls int32
+	done := make(chan error)
+	go func() {
+		done <- agent.sendWithRetry(func() error {
+			atomic.AddInt32(&calls, 1)
+			return &agentResponseError{code: http.StatusServiceUnavailable}
+		})
+	}()
+
+	for retry := 1; retry <= 2; retry++ {
+		clock.waitTimers(t, 1)
+		assert.Equal(t, int32(retry), atomic.LoadInt32(&calls), "Retry %d should wait for the backoff", retry)
+		clock.Advance(time.Hour)
+	}
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Retries did not end")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
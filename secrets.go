@@ -0,0 +1,95 @@
+package instana
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Secrets matchers, the ways a key such as a header or query parameter
+// name is checked against the secrets list
+const (
+	SecretsEqualsIgnoreCase   = "equals-ignore-case"
+	SecretsEquals             = "equals"
+	SecretsContainsIgnoreCase = "contains-ignore-case"
+	SecretsContains           = "contains"
+	SecretsRegex              = "regex"
+	SecretsNone               = "none"
+
+	DefaultSecretsMatcher = SecretsContainsIgnoreCase
+)
+
+// SecretsMask replaces the values of secrets.
+const SecretsMask = "<redacted>"
+
+var defaultSecretsList = []string{"key", "pass", "secret"}
+
+// secretsMatcherS tells whether a key holds a secret.
+type secretsMatcherS struct {
+	matcher string
+	list    []string
+	res     []*regexp.Regexp
+}
+
+func newSecretsMatcher(matcher string, list []string) (*secretsMatcherS, error) {
+	ret := &secretsMatcherS{matcher: matcher, list: list}
+
+	switch matcher {
+	case SecretsEqualsIgnoreCase, SecretsContainsIgnoreCase:
+		ret.list = make([]string, len(list))
+		for i, s := range list {
+			ret.list[i] = strings.ToLower(s)
+		}
+	case SecretsEquals, SecretsContains, SecretsNone:
+	case SecretsRegex:
+		for _, s := range list {
+			// the agent expects the whole key to match
+			re, err := regexp.Compile("^(?:" + s + ")$")
+			if err != nil {
+				return nil, err
+			}
+			ret.res = append(ret.res, re)
+		}
+	default:
+		return nil, fmt.Errorf("unknown secrets matcher %q", matcher)
+	}
+
+	return ret, nil
+}
+
+func defaultSecretsMatcher() *secretsMatcherS {
+	ret, _ := newSecretsMatcher(DefaultSecretsMatcher, defaultSecretsList)
+
+	return ret
+}
+
+// match reports whether the value of key is a secret.
+func (r *secretsMatcherS) match(key string) bool {
+	switch r.matcher {
+	case SecretsEqualsIgnoreCase, SecretsContainsIgnoreCase:
+		key = strings.ToLower(key)
+	case SecretsRegex:
+		for _, re := range r.res {
+			if re.MatchString(key) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, s := range r.list {
+		switch r.matcher {
+		case SecretsEquals, SecretsEqualsIgnoreCase:
+			if key == s {
+				return true
+			}
+		case SecretsContains, SecretsContainsIgnoreCase:
+			if strings.Contains(key, s) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -3,18 +3,35 @@ package instana
 import (
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	DefaultMaxBufferedSpans = 1000
-	DefaultForceSpanSendAt  = 500
+	DefaultMaxBufferedSpans   = 1000
+	DefaultForceSpanSendAt    = 500
+	DefaultPreReadySpanMaxAge = 60 * time.Second
+	DefaultSpoolMaxBytes      = 64 << 20
+	DefaultMaxSpansPerBatch   = 500
+	DefaultMaxBatchBytes      = 1 << 20
+	DefaultFlushInterval      = 1 * time.Second
+	DefaultMetricsInterval    = 1 * time.Second
+	DefaultSnapshotInterval   = SnapshotPeriod * time.Second
+	DefaultAgentRetryPeriod   = 30 * time.Second
+	DefaultAgentMaxRetries    = 2
 )
 
 type sensorS struct {
 	meter       *meterS
+	poller      *actionPollerS
 	agent       *agentS
 	options     *Options
 	serviceName string
+	clock       clock
+
+	configMu sync.RWMutex
+	config   *configS
 }
 
 var sensor *sensorS
@@ -24,8 +41,26 @@ func (r *sensorS) init(options *Options) {
 	if r.meter == nil {
 		r.setOptions(options)
 		r.configureServiceName()
+		r.setConfig(newConfig(r.options, nil))
 		r.agent = r.initAgent()
 		r.meter = r.initMeter()
+		r.poller = r.initActionPoller()
+	}
+}
+
+// stop stops looking up the agent, sending metrics and polling the agent
+// for actions.
+func (r *sensorS) stop() {
+	if r.poller != nil {
+		r.poller.stop()
+	}
+
+	if r.meter != nil {
+		r.meter.stop()
+	}
+
+	if r.agent != nil && r.agent.fsm != nil {
+		r.agent.fsm.stop()
 	}
 }
 
@@ -42,6 +77,92 @@ func (r *sensorS) setOptions(options *Options) {
 	if r.options.ForceTransmissionStartingAt == 0 {
 		r.options.ForceTransmissionStartingAt = DefaultForceSpanSendAt
 	}
+
+	if r.options.PreReadySpanMaxAge == 0 {
+		r.options.PreReadySpanMaxAge = DefaultPreReadySpanMaxAge
+	}
+
+	if r.options.SpoolMaxBytes == 0 {
+		r.options.SpoolMaxBytes = DefaultSpoolMaxBytes
+	}
+
+	if r.options.EndpointURL == "" {
+		r.options.EndpointURL = os.Getenv("INSTANA_ENDPOINT_URL")
+	}
+
+	if r.options.AgentKey == "" {
+		r.options.AgentKey = os.Getenv("INSTANA_AGENT_KEY")
+	}
+
+	if r.options.MaxSpansPerBatch == 0 {
+		r.options.MaxSpansPerBatch = DefaultMaxSpansPerBatch
+	}
+
+	if r.options.MaxBatchBytes == 0 {
+		r.options.MaxBatchBytes = DefaultMaxBatchBytes
+	}
+
+	setDefaultDuration("FlushInterval", &r.options.FlushInterval, DefaultFlushInterval)
+	setDefaultDuration("MetricsInterval", &r.options.MetricsInterval, DefaultMetricsInterval)
+	setDefaultDuration("SnapshotInterval", &r.options.SnapshotInterval, DefaultSnapshotInterval)
+	setDefaultDuration("AgentRetryPeriod", &r.options.AgentRetryPeriod, DefaultAgentRetryPeriod)
+	setDefaultDuration("AgentTimeout", &r.options.AgentTimeout, DefaultAgentTimeout)
+	setDefaultDuration("AgentRequestsInterval", &r.options.AgentRequestsInterval, DefaultAgentRequestsInterval)
+
+	r.options.AgentSocket = strings.TrimPrefix(r.options.AgentSocket, "unix://")
+	if r.options.AgentSocket != "" && r.options.AgentTransport != nil {
+		log.warn("AgentTransport is set, ignoring AgentSocket", r.options.AgentSocket)
+		r.options.AgentSocket = ""
+	}
+
+	switch r.options.AgentScheme {
+	case "http", "https":
+	case "":
+		r.options.AgentScheme = DefaultAgentScheme
+	default:
+		log.warn("Invalid AgentScheme", r.options.AgentScheme, "using the default")
+		r.options.AgentScheme = DefaultAgentScheme
+	}
+
+	if r.options.SnapshotInterval < r.options.MetricsInterval {
+		log.warn("SnapshotInterval is shorter than MetricsInterval, sending the snapshot with every metrics report")
+		r.options.SnapshotInterval = r.options.MetricsInterval
+	}
+
+	if r.options.SamplingRate < 0 || r.options.SamplingRate > 1 {
+		log.warn("Invalid SamplingRate", r.options.SamplingRate, "ignoring it")
+		r.options.SamplingRate = 0
+	}
+
+	if r.options.AgentMaxRetries < 0 {
+		log.warn("Invalid AgentMaxRetries", r.options.AgentMaxRetries, "using the default")
+		r.options.AgentMaxRetries = 0
+	}
+
+	if r.options.AgentMaxRetries == 0 {
+		r.options.AgentMaxRetries = DefaultAgentMaxRetries
+	}
+}
+
+// setDefaultDuration sets an unset or invalid interval option to its
+// default.
+func setDefaultDuration(name string, d *time.Duration, def time.Duration) {
+	if *d < 0 {
+		log.warn("Invalid", name, *d, "using the default", def)
+		*d = 0
+	}
+
+	if *d == 0 {
+		*d = def
+	}
+}
+
+func (r *sensorS) getClock() clock {
+	if r == nil || r.clock == nil {
+		return systemClock
+	}
+
+	return r.clock
 }
 
 func (r *sensorS) getOptions() *Options {
@@ -71,9 +71,44 @@ func (r *spanS) FinishWithOptions(opts ot.FinishOptions) {
 	}
 
 	r.Duration = duration
+
+	// the sampling decision of the sensor applies to every recorder, not
+	// only to the one sending to the agent
+	if sensor != nil && !sensor.getConfig().records(r.context.TraceID) {
+		return
+	}
+
 	r.tracer.options.Recorder.RecordSpan(r)
 }
 
+// clone returns a copy of the span that stays untouched by later changes to
+// the span. The caller must hold the lock.
+func (r *spanS) clone() *spanS {
+	c := &spanS{
+		tracer:       r.tracer,
+		context:      r.context,
+		ParentSpanID: r.ParentSpanID,
+		Operation:    r.Operation,
+		Start:        r.Start,
+		Duration:     r.Duration,
+		Error:        r.Error,
+		Ec:           r.Ec}
+
+	if r.Tags != nil {
+		c.Tags = make(ot.Tags, len(r.Tags))
+		for k, v := range r.Tags {
+			c.Tags[k] = v
+		}
+	}
+
+	if r.Logs != nil {
+		c.Logs = make([]ot.LogRecord, len(r.Logs))
+		copy(c.Logs, r.Logs)
+	}
+
+	return c
+}
+
 func (r *spanS) appendLog(lr ot.LogRecord) {
 	maxLogs := r.tracer.options.MaxLogsPerSpan
 	if maxLogs == 0 || len(r.Logs) < maxLogs {
@@ -0,0 +1,236 @@
+package instana
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolFileExt = ".json.gz"
+	spoolTempExt = ".tmp"
+)
+
+// spoolS keeps trace batches that could not be delivered to the agent in
+// a directory of gzip compressed files and replays them, oldest first, once
+// the agent is reachable again. Every batch is written to a temporary file
+// which is renamed into place, so a crash never leaves a partial batch behind.
+type spoolS struct {
+	sync.Mutex
+	dir      string
+	maxBytes int64
+	seq      int64
+}
+
+// spoolBatchS is a spooled batch, along with the PID of the process that
+// recorded it.
+type spoolBatchS struct {
+	PID   int        `json:"pid"`
+	Spans []jsonSpan `json:"spans"`
+}
+
+func newSpool(dir string, maxBytes int64) (*spoolS, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	r := &spoolS{dir: dir, maxBytes: maxBytes}
+	r.recover()
+
+	return r, nil
+}
+
+// recover removes temporary files left over by an interrupted write and
+// makes sure new batches are ordered after the ones already spooled.
+func (r *spoolS) recover() {
+	r.seq = time.Now().UnixNano()
+
+	entries, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		log.error("Cannot read span spool:", err)
+		return
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case strings.HasSuffix(name, spoolTempExt):
+			log.debug("Removing incomplete spooled batch", name)
+			os.Remove(filepath.Join(r.dir, name))
+		case strings.HasSuffix(name, spoolFileExt):
+			seq, err := strconv.ParseInt(strings.TrimSuffix(name, spoolFileExt), 10, 64)
+			if err == nil && seq >= r.seq {
+				r.seq = seq + 1
+			}
+		}
+	}
+}
+
+// batches returns the names of the spooled batch files, oldest first.
+func (r *spoolS) batches() ([]string, int64) {
+	entries, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		log.error("Cannot read span spool:", err)
+		return nil, 0
+	}
+
+	var names []string
+	var size int64
+	for _, e := range entries {
+		if e.Mode().IsRegular() && strings.HasSuffix(e.Name(), spoolFileExt) {
+			names = append(names, e.Name())
+			size += e.Size()
+		}
+	}
+	sort.Strings(names)
+
+	return names, size
+}
+
+// write stores a batch of spans in the spool. Once the spool grows past
+// its size cap the oldest batches are dropped.
+func (r *spoolS) write(spans []jsonSpan) error {
+	r.Lock()
+	defer r.Unlock()
+
+	name := fmt.Sprintf("%020d%s", r.seq, spoolFileExt)
+	r.seq++
+
+	if err := r.writeFile(name, spoolBatchS{PID: os.Getpid(), Spans: spans}); err != nil {
+		return err
+	}
+
+	r.enforceLimit()
+
+	return nil
+}
+
+// writeFile writes batch to the file name through a temporary file,
+// replacing the batch if it exists. The caller must hold the lock.
+func (r *spoolS) writeFile(name string, batch spoolBatchS) error {
+	tmpName := filepath.Join(r.dir, name+spoolTempExt)
+	tmp, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(tmp)
+	err = json.NewEncoder(zw).Encode(batch)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filepath.Join(r.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+
+	return err
+}
+
+// enforceLimit drops the oldest batches until the spool fits into its
+// size cap. The caller must hold the lock.
+func (r *spoolS) enforceLimit() {
+	names, size := r.batches()
+	for _, name := range names {
+		if size <= r.maxBytes {
+			return
+		}
+
+		path := filepath.Join(r.dir, name)
+		if fi, err := os.Stat(path); err == nil {
+			size -= fi.Size()
+		}
+
+		log.debug("Span spool is full, dropping batch", name)
+		os.Remove(path)
+	}
+}
+
+func (r *spoolS) read(name string) (spoolBatchS, error) {
+	var batch spoolBatchS
+
+	f, err := os.Open(filepath.Join(r.dir, name))
+	if err != nil {
+		return batch, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return batch, err
+	}
+	defer zr.Close()
+
+	err = json.NewDecoder(zr).Decode(&batch)
+
+	return batch, err
+}
+
+// replay hands the spooled batches, oldest first, to send along with the
+// PID of the process that recorded them and removes every batch that was
+// delivered. Replaying stops at the first failed delivery so the order is
+// kept, send returns the spans it could not deliver then and only those
+// are kept. Corrupt batches are discarded.
+func (r *spoolS) replay(send func(pid int, spans []jsonSpan) ([]jsonSpan, error)) error {
+	r.Lock()
+	names, _ := r.batches()
+	r.Unlock()
+
+	for _, name := range names {
+		batch, err := r.read(name)
+		if os.IsNotExist(err) {
+			// dropped by the size cap in the meantime
+			continue
+		}
+
+		if err != nil {
+			log.warn("Discarding corrupt spooled batch", name, err)
+			os.Remove(filepath.Join(r.dir, name))
+			continue
+		}
+
+		if unsent, err := send(batch.PID, batch.Spans); err != nil {
+			if len(unsent) < len(batch.Spans) {
+				r.keepUnsent(name, spoolBatchS{PID: batch.PID, Spans: unsent})
+			}
+			return err
+		}
+
+		log.debug("Replayed spooled batch", name, "Count:", len(batch.Spans))
+		os.Remove(filepath.Join(r.dir, name))
+	}
+
+	return nil
+}
+
+// keepUnsent replaces a partly delivered batch with the spans that were
+// not delivered, so they are not sent twice.
+func (r *spoolS) keepUnsent(name string, unsent spoolBatchS) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(unsent.Spans) == 0 {
+		os.Remove(filepath.Join(r.dir, name))
+		return
+	}
+
+	if err := r.writeFile(name, unsent); err != nil {
+		log.error("Cannot update spooled batch", name, err)
+	}
+}
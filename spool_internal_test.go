@@ -0,0 +1,163 @@
+package instana
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSpool(t *testing.T, maxBytes int64) (*spoolS, string) {
+	InitSensor(&Options{LogLevel: Debug})
+
+	dir, err := ioutil.TempDir("", "instana-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err := newSpool(dir, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return spool, dir
+}
+
+func TestSpoolReplayInOrder(t *testing.T) {
+	spool, dir := newTestSpool(t, DefaultSpoolMaxBytes)
+	defer os.RemoveAll(dir)
+
+	for i := int64(1); i <= 3; i++ {
+		assert.NoError(t, spool.write([]jsonSpan{{SpanID: i}}))
+	}
+
+	var replayed []int64
+	err := spool.replay(func(pid int, spans []jsonSpan) ([]jsonSpan, error) {
+		replayed = append(replayed, spans[0].SpanID)
+		return nil, nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2, 3}, replayed, "Batches should be replayed oldest first")
+
+	names, _ := spool.batches()
+	assert.Empty(t, names, "Replayed batches should be removed")
+}
+
+func TestSpoolReplayStopsOnFailure(t *testing.T) {
+	spool, dir := newTestSpool(t, DefaultSpoolMaxBytes)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, spool.write([]jsonSpan{{SpanID: 1}}))
+	assert.NoError(t, spool.write([]jsonSpan{{SpanID: 2}}))
+
+	calls := 0
+	err := spool.replay(func(pid int, spans []jsonSpan) ([]jsonSpan, error) {
+		calls++
+		return spans, errors.New("agent gone")
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls, "Replay should stop at the first failed batch")
+
+	names, _ := spool.batches()
+	assert.Equal(t, 2, len(names), "Undelivered batches should be kept")
+}
+
+func TestSpoolReplayKeepsUnsentSpans(t *testing.T) {
+	spool, dir := newTestSpool(t, DefaultSpoolMaxBytes)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, spool.write([]jsonSpan{{SpanID: 1}, {SpanID: 2}, {SpanID: 3}, {SpanID: 4}}))
+
+	// the first half gets through, the second one fails
+	err := spool.replay(func(pid int, spans []jsonSpan) ([]jsonSpan, error) {
+		return spans[2:], errors.New("agent gone")
+	})
+	assert.Error(t, err)
+
+	var replayed []int64
+	err = spool.replay(func(pid int, spans []jsonSpan) ([]jsonSpan, error) {
+		for _, span := range spans {
+			replayed = append(replayed, span.SpanID)
+		}
+		return nil, nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{3, 4}, replayed, "Delivered spans should not be replayed again")
+}
+
+func TestSpoolSizeCap(t *testing.T) {
+	spool, dir := newTestSpool(t, DefaultSpoolMaxBytes)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, spool.write([]jsonSpan{{SpanID: 1}}))
+	_, size := spool.batches()
+
+	// room for two batches only
+	spool.maxBytes = 2*size + size/2
+	assert.NoError(t, spool.write([]jsonSpan{{SpanID: 2}}))
+	assert.NoError(t, spool.write([]jsonSpan{{SpanID: 3}}))
+
+	var replayed []int64
+	spool.replay(func(pid int, spans []jsonSpan) ([]jsonSpan, error) {
+		replayed = append(replayed, spans[0].SpanID)
+		return nil, nil
+	})
+
+	assert.Equal(t, []int64{2, 3}, replayed, "Oldest batch should be dropped when the spool is full")
+}
+
+func TestSpoolCrashRecovery(t *testing.T) {
+	spool, dir := newTestSpool(t, DefaultSpoolMaxBytes)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, spool.write([]jsonSpan{{SpanID: 1}}))
+
+	// a write interrupted before the rename
+	partial := filepath.Join(dir, "99999999999999999999"+spoolFileExt+spoolTempExt)
+	assert.NoError(t, ioutil.WriteFile(partial, []byte("garbage"), 0600))
+
+	recovered, err := newSpool(dir, DefaultSpoolMaxBytes)
+	assert.NoError(t, err)
+
+	_, err = os.Stat(partial)
+	assert.True(t, os.IsNotExist(err), "Incomplete batch should be removed on recovery")
+
+	assert.NoError(t, recovered.write([]jsonSpan{{SpanID: 2}}))
+
+	var replayed []int64
+	recovered.replay(func(pid int, spans []jsonSpan) ([]jsonSpan, error) {
+		replayed = append(replayed, spans[0].SpanID)
+		return nil, nil
+	})
+
+	assert.Equal(t, []int64{1, 2}, replayed)
+}
+
+func TestSpoolCorruptBatch(t *testing.T) {
+	spool, dir := newTestSpool(t, DefaultSpoolMaxBytes)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, spool.write([]jsonSpan{{SpanID: 1}}))
+	names, _ := spool.batches()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, names[0]), []byte("not gzip"), 0600))
+
+	assert.NoError(t, spool.write([]jsonSpan{{SpanID: 2}}))
+
+	var replayed []int64
+	err := spool.replay(func(pid int, spans []jsonSpan) ([]jsonSpan, error) {
+		replayed = append(replayed, spans[0].SpanID)
+		return nil, nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2}, replayed, "Corrupt batch should be skipped")
+
+	names, _ = spool.batches()
+	assert.Empty(t, names, "Corrupt batch should be removed")
+}
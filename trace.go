@@ -0,0 +1,251 @@
+package instana
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Trace is the tree of the recorded spans sharing a trace ID.
+type Trace struct {
+	ID int64
+	// Roots are the spans without a parent. A complete trace has one.
+	Roots []*TraceNode
+	// Orphans are the spans whose parent is missing from the recorded
+	// spans, they are kept with their own children.
+	Orphans []*TraceNode
+	// Spans is the number of spans in the trace.
+	Spans int
+}
+
+// TraceNode is a span along with its child spans, ordered by start time.
+type TraceNode struct {
+	Span     RecordedSpan
+	Children []*TraceNode
+}
+
+// BuildTraces groups spans into traces and assembles their span trees.
+// Traces are ordered by the start time of their earliest span.
+func BuildTraces(spans RecordedSpans) []*Trace {
+	var traces []*Trace
+	byID := make(map[int64]RecordedSpans)
+	for _, span := range spans {
+		if _, ok := byID[span.TraceID()]; !ok {
+			traces = append(traces, &Trace{ID: span.TraceID()})
+		}
+		byID[span.TraceID()] = append(byID[span.TraceID()], span)
+	}
+
+	for _, t := range traces {
+		t.build(byID[t.ID])
+	}
+
+	sort.SliceStable(traces, func(i, j int) bool {
+		return traces[i].Start().Before(traces[j].Start())
+	})
+
+	return traces
+}
+
+func (t *Trace) build(spans RecordedSpans) {
+	t.Spans = len(spans)
+
+	nodes := make([]*TraceNode, len(spans))
+	bySpanID := make(map[int64]*TraceNode, len(spans))
+	for i, span := range spans {
+		nodes[i] = &TraceNode{Span: span}
+		if _, ok := bySpanID[span.SpanID()]; !ok {
+			bySpanID[span.SpanID()] = nodes[i]
+		}
+	}
+
+	for _, node := range nodes {
+		parentID, ok := node.Span.ParentID()
+		if !ok {
+			t.Roots = append(t.Roots, node)
+			continue
+		}
+
+		if parent, ok := bySpanID[parentID]; ok && parent != node {
+			parent.Children = append(parent.Children, node)
+		} else {
+			t.Orphans = append(t.Orphans, node)
+		}
+	}
+
+	// spans referencing each other in a cycle are not reachable from any
+	// root or orphan, break the cycle by treating them as orphans
+	seen := make(map[*TraceNode]bool, len(nodes))
+	for _, node := range append(append([]*TraceNode(nil), t.Roots...), t.Orphans...) {
+		node.walk(func(n *TraceNode, _ int) { seen[n] = true })
+	}
+
+	for _, node := range nodes {
+		if seen[node] {
+			continue
+		}
+
+		for _, n := range nodes {
+			n.Children = removeNode(n.Children, node)
+		}
+		t.Orphans = append(t.Orphans, node)
+		node.walk(func(n *TraceNode, _ int) { seen[n] = true })
+	}
+
+	sortNodes(t.Roots)
+	sortNodes(t.Orphans)
+	for _, node := range nodes {
+		sortNodes(node.Children)
+	}
+}
+
+// Start returns the start time of the earliest span of the trace.
+func (t *Trace) Start() time.Time {
+	var start time.Time
+	for _, node := range append(append([]*TraceNode(nil), t.Roots...), t.Orphans...) {
+		node.walk(func(n *TraceNode, _ int) {
+			if start.IsZero() || n.Span.Timestamp().Before(start) {
+				start = n.Span.Timestamp()
+			}
+		})
+	}
+
+	return start
+}
+
+// Complete tells whether the trace has a single root and no orphans.
+func (t *Trace) Complete() bool {
+	return len(t.Roots) == 1 && len(t.Orphans) == 0
+}
+
+// walk calls fn for the node and its descendants, depth first.
+func (n *TraceNode) walk(fn func(n *TraceNode, depth int)) {
+	var visit func(n *TraceNode, depth int)
+	visit = func(n *TraceNode, depth int) {
+		fn(n, depth)
+		for _, child := range n.Children {
+			visit(child, depth+1)
+		}
+	}
+
+	visit(n, 0)
+}
+
+func sortNodes(nodes []*TraceNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Span.Timestamp().Before(nodes[j].Span.Timestamp())
+	})
+}
+
+func removeNode(nodes []*TraceNode, node *TraceNode) []*TraceNode {
+	for i, n := range nodes {
+		if n == node {
+			return append(nodes[:i], nodes[i+1:]...)
+		}
+	}
+
+	return nodes
+}
+
+// WriteTraces renders traces as an indented timeline, one span per line
+// with its start offset from the beginning of the trace, duration, kind
+// and error count. Orphans and traces with several roots are flagged.
+func WriteTraces(w io.Writer, traces []*Trace) error {
+	bw := bufio.NewWriter(w)
+
+	for i, t := range traces {
+		if i > 0 {
+			fmt.Fprintln(bw)
+		}
+
+		fmt.Fprintf(bw, "trace %016x: %d spans", uint64(t.ID), t.Spans)
+		if len(t.Roots) != 1 {
+			fmt.Fprintf(bw, ", %d roots", len(t.Roots))
+		}
+		if len(t.Orphans) > 0 {
+			fmt.Fprintf(bw, ", %d orphans", len(t.Orphans))
+		}
+		fmt.Fprintln(bw)
+
+		start := t.Start()
+		for _, root := range t.Roots {
+			writeTraceNode(bw, root, start, "")
+		}
+
+		for _, orphan := range t.Orphans {
+			parentID, _ := orphan.Span.ParentID()
+			fmt.Fprintf(bw, "  orphan, parent %016x not found:\n", uint64(parentID))
+			writeTraceNode(bw, orphan, start, "  ")
+		}
+	}
+
+	return bw.Flush()
+}
+
+func writeTraceNode(w io.Writer, node *TraceNode, start time.Time, indent string) {
+	node.walk(func(n *TraceNode, depth int) {
+		span := n.Span
+
+		line := fmt.Sprintf("%s%s%s +%v %v", indent, strings.Repeat("  ", depth+1),
+			span.Operation(), span.Timestamp().Sub(start), span.Duration())
+		if kind := span.Kind(); kind != "" {
+			line += " " + kind
+		}
+		if span.Errored() || span.ErrorCount() > 0 {
+			line += fmt.Sprintf(" ERROR(%d)", span.ErrorCount())
+		}
+
+		fmt.Fprintf(w, "%s [%016x]\n", line, uint64(span.SpanID()))
+	})
+}
+
+// ReadRecordedSpans reads a span dump, either a JSON array of spans in the
+// format sent to the agent or a stream of such span objects as written by
+// the JSONRecorder.
+func ReadRecordedSpans(r io.Reader) (RecordedSpans, error) {
+	br := bufio.NewReader(r)
+
+	// peek at the first non-space byte to tell an array from a stream
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			continue
+		}
+
+		br.UnreadByte()
+		if b == '[' {
+			var spans RecordedSpans
+			if err := json.NewDecoder(br).Decode(&spans); err != nil {
+				return nil, err
+			}
+
+			return spans, nil
+		}
+
+		break
+	}
+
+	var spans RecordedSpans
+	dec := json.NewDecoder(br)
+	for {
+		var span RecordedSpan
+		if err := dec.Decode(&span); err == io.EOF {
+			return spans, nil
+		} else if err != nil {
+			return spans, err
+		}
+
+		spans = append(spans, span)
+	}
+}
@@ -0,0 +1,130 @@
+package instana
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRecordedSpan(traceID, spanID, parentID int64, op, kind string, ts, d uint64) RecordedSpan {
+	span := jsonSpan{
+		TraceID:   traceID,
+		SpanID:    spanID,
+		Timestamp: ts,
+		Duration:  d,
+		Name:      "sdk",
+		Data:      &jsonData{SDK: &jsonSDKData{Name: op, Type: kind}}}
+	if parentID != 0 {
+		span.ParentID = &parentID
+	}
+
+	return RecordedSpan{span: span}
+}
+
+func TestBuildTraces(t *testing.T) {
+	spans := RecordedSpans{
+		newTestRecordedSpan(2, 20, 0, "later", "entry", 2000, 5),
+		newTestRecordedSpan(1, 12, 10, "second", "exit", 1050, 10),
+		newTestRecordedSpan(1, 11, 10, "first", "exit", 1010, 10),
+		newTestRecordedSpan(1, 10, 0, "root", "entry", 1000, 100),
+		newTestRecordedSpan(1, 13, 11, "nested", "", 1012, 2),
+	}
+
+	traces := BuildTraces(spans)
+	assert.Len(t, traces, 2)
+
+	tr := traces[0]
+	assert.Equal(t, int64(1), tr.ID)
+	assert.Equal(t, 4, tr.Spans)
+	assert.True(t, tr.Complete())
+
+	root := tr.Roots[0]
+	assert.Equal(t, "root", root.Span.Operation())
+	if assert.Len(t, root.Children, 2) {
+		assert.Equal(t, "first", root.Children[0].Span.Operation())
+		assert.Equal(t, "second", root.Children[1].Span.Operation())
+		assert.Equal(t, "nested", root.Children[0].Children[0].Span.Operation())
+	}
+
+	assert.Equal(t, int64(2), traces[1].ID)
+}
+
+func TestBuildTracesIncomplete(t *testing.T) {
+	spans := RecordedSpans{
+		newTestRecordedSpan(1, 10, 0, "root-a", "entry", 1000, 10),
+		newTestRecordedSpan(1, 11, 0, "root-b", "entry", 1001, 10),
+		newTestRecordedSpan(1, 12, 99, "orphan", "exit", 1002, 10),
+		newTestRecordedSpan(1, 13, 12, "orphan-child", "", 1003, 1),
+		// a cycle is broken up rather than dropped
+		newTestRecordedSpan(1, 14, 15, "cycle-a", "", 1004, 1),
+		newTestRecordedSpan(1, 15, 14, "cycle-b", "", 1005, 1),
+	}
+
+	traces := BuildTraces(spans)
+	if !assert.Len(t, traces, 1) {
+		return
+	}
+
+	tr := traces[0]
+	assert.False(t, tr.Complete())
+	assert.Len(t, tr.Roots, 2)
+	if assert.Len(t, tr.Orphans, 2) {
+		assert.Equal(t, "orphan", tr.Orphans[0].Span.Operation())
+		assert.Len(t, tr.Orphans[0].Children, 1)
+		assert.Equal(t, "cycle-a", tr.Orphans[1].Span.Operation())
+		assert.Len(t, tr.Orphans[1].Children, 1)
+	}
+}
+
+func TestWriteTraces(t *testing.T) {
+	failed := newTestRecordedSpan(1, 11, 10, "query", "exit", 1005, 20)
+	failed.span.Error = true
+	failed.span.Ec = 1
+
+	spans := RecordedSpans{
+		newTestRecordedSpan(1, 10, 0, "handle", "entry", 1000, 120),
+		failed,
+		newTestRecordedSpan(1, 12, 99, "lost", "", 1010, 3),
+	}
+
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, WriteTraces(buf, BuildTraces(spans)))
+
+	assert.Equal(t, strings.Join([]string{
+		"trace 0000000000000001: 3 spans, 1 orphans",
+		"  handle +0s 120ms entry [000000000000000a]",
+		"    query +5ms 20ms exit ERROR(1) [000000000000000b]",
+		"  orphan, parent 0000000000000063 not found:",
+		"    lost +10ms 3ms [000000000000000c]",
+		""}, "\n"), buf.String())
+}
+
+func TestReadRecordedSpans(t *testing.T) {
+	array := `[{"t":1,"s":10,"ts":1000,"d":5,"n":"sdk","data":{"sdk":{"name":"a"}}},
+		{"t":1,"p":10,"s":11,"ts":1001,"d":1,"n":"sdk","data":{"sdk":{"name":"b"}}}]`
+	lines := `{"t":1,"s":10,"ts":1000,"d":5,"n":"sdk","data":{"sdk":{"name":"a"}}}
+{
+  "t": 1, "p": 10, "s": 11, "ts": 1001, "d": 1, "n": "sdk",
+  "data": {"sdk": {"name": "b"}}
+}
+`
+
+	for name, dump := range map[string]string{"array": array, "lines": lines} {
+		spans, err := ReadRecordedSpans(strings.NewReader("\n  " + dump))
+		assert.NoError(t, err, name)
+		if assert.Len(t, spans, 2, name) {
+			assert.Equal(t, "a", spans[0].Operation(), name)
+			parentID, _ := spans[1].ParentID()
+			assert.Equal(t, int64(10), parentID, name)
+		}
+	}
+
+	spans, err := ReadRecordedSpans(strings.NewReader(""))
+	assert.NoError(t, err)
+	assert.Empty(t, spans)
+
+	_, err = ReadRecordedSpans(strings.NewReader(`{"t":`))
+	assert.Error(t, err)
+}
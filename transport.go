@@ -0,0 +1,64 @@
+package instana
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	DefaultAgentTimeout = 5 * time.Second
+	DefaultAgentScheme  = "http"
+)
+
+// newAgentClient returns the client the agent is talked to with. The
+// transport is the AgentTransport option if set, otherwise one with the
+// AgentSocket, AgentTLSConfig and AgentProxyURL options.
+func newAgentClient(options *Options) *http.Client {
+	ret := &http.Client{Timeout: options.AgentTimeout}
+
+	if options.AgentTransport != nil {
+		ret.Transport = options.AgentTransport
+		return ret
+	}
+
+	if options.AgentSocket == "" && options.AgentTLSConfig == nil && options.AgentProxyURL == "" {
+		// the default transport, proxied as the environment says
+		return ret
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if options.AgentProxyURL != "" {
+		if u, err := url.Parse(options.AgentProxyURL); err != nil {
+			log.warn("Invalid AgentProxyURL", options.AgentProxyURL, err)
+		} else {
+			proxy = http.ProxyURL(u)
+		}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second}
+	dial := dialer.DialContext
+
+	if path := options.AgentSocket; path != "" {
+		// every request goes over the socket, whatever host it is for
+		proxy = nil
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", path)
+		}
+	}
+
+	ret.Transport = &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		TLSClientConfig:       options.AgentTLSConfig,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second}
+
+	return ret
+}
@@ -0,0 +1,186 @@
+package instana
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestAgentHTTPS(t *testing.T) {
+	var tlsRequests int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil {
+			atomic.AddInt32(&tlsRequests, 1)
+		}
+	}))
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	agent := newTestAgent(&Options{
+		AgentScheme:    "https",
+		AgentTLSConfig: &tls.Config{RootCAs: pool}})
+	useTestServer(t, agent, srv)
+
+	url := agent.makeURL(agentDataURL)
+	assert.Contains(t, url, "https://")
+
+	_, err := agent.head(url)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tlsRequests))
+
+	// the certificate of the test server is not trusted otherwise
+	agent = newTestAgent(&Options{AgentScheme: "https"})
+	useTestServer(t, agent, srv)
+	_, err = agent.head(agent.makeURL(agentDataURL))
+	assert.Error(t, err)
+}
+
+func TestAgentProxyURL(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxied <- req.URL.Host
+	}))
+	defer proxy.Close()
+
+	agent := newTestAgent(&Options{AgentProxyURL: proxy.URL})
+	agent.setHost("agent.invalid")
+
+	_, err := agent.head(agent.makeURL(agentDataURL))
+	assert.NoError(t, err)
+	assert.Equal(t, "agent.invalid:42699", <-proxied)
+}
+
+func TestAgentTransport(t *testing.T) {
+	var requests int32
+	agent := newTestAgent(&Options{
+		AgentProxyURL: "http://proxy.invalid",
+		AgentTransport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&requests, 1)
+			return httptest.NewRecorder().Result(), nil
+		})})
+
+	_, err := agent.head(agent.makeURL(agentDataURL))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestAgentTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	agent := newTestAgent(&Options{AgentTimeout: 20 * time.Millisecond})
+	useTestServer(t, agent, srv)
+
+	_, err := agent.head(agent.makeURL(agentDataURL))
+	assert.Error(t, err)
+
+	assert.Equal(t, DefaultAgentTimeout, newTestAgent(&Options{}).client.Timeout)
+}
+
+func TestSetOptionsAgentScheme(t *testing.T) {
+	InitSensor(&Options{LogLevel: Error})
+
+	for scheme, expected := range map[string]string{
+		"":      "http",
+		"http":  "http",
+		"https": "https",
+		"ftp":   "http",
+	} {
+		s := &sensorS{}
+		s.setOptions(&Options{AgentScheme: scheme})
+		assert.Equal(t, expected, s.options.AgentScheme, scheme)
+	}
+}
+
+func TestAgentSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instana-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("no Unix domain sockets:", err)
+	}
+
+	var mu sync.Mutex
+	var announce discoveryS
+	var traces int
+	srv := &httptest.Server{
+		Listener: l,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch req.URL.Path {
+			case "/":
+				w.Header().Set("Server", agentHeader)
+			case agentDiscoveryURL:
+				json.NewDecoder(req.Body).Decode(&announce)
+				w.Write([]byte(`{"pid":4242,"agentUuid":"agent-id"}`))
+			case agentTracesURL + "4242":
+				traces++
+			}
+		})}}
+	srv.Start()
+	defer srv.Close()
+
+	agent := newTestAgent(&Options{
+		AgentSocket:      "unix://" + path,
+		AgentRetryPeriod: time.Millisecond,
+		// not looked at, all requests go over the socket
+		AgentDiscovery: []AgentDiscoverySource{DiscoverHosts("agent.invalid")}})
+	assert.Equal(t, path, agent.sensor.options.AgentSocket)
+
+	agent.fsm.stop()
+	agent.state = agentStateS{}
+	agent.initFsm()
+	waitAgentReady(t, agent)
+
+	_, err = agent.request(agent.makeURL(agentTracesURL), "POST", []jsonSpan{})
+	assert.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "4242", agent.getFrom().PID)
+	assert.NotZero(t, announce.PID)
+	assert.Empty(t, announce.Fd, "The connection can't be told over a socket")
+	assert.Empty(t, announce.Inode)
+	assert.Equal(t, 1, traces)
+}
+
+func TestAgentTransportOverridesSocket(t *testing.T) {
+	agent := newTestAgent(&Options{
+		AgentSocket: "unix:///var/run/instana/agent.sock",
+		AgentTransport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return httptest.NewRecorder().Result(), nil
+		})})
+
+	assert.Equal(t, "", agent.sensor.options.AgentSocket, "AgentSocket should be ignored along with agent discovery")
+}
@@ -89,6 +89,10 @@ func getCommandLine() (string, []string) {
 		}
 		return false
 	})
+	if len(parts) == 0 {
+		return os.Args[0], os.Args[1:]
+	}
+
 	log.debug("cmdline says:", parts[0], parts[1:])
 	return parts[0], parts[1:]
 }
@@ -0,0 +1,199 @@
+package instana
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+type zipkinSpan struct {
+	TraceID        string             `json:"traceId"`
+	ID             string             `json:"id"`
+	ParentID       string             `json:"parentId,omitempty"`
+	Name           string             `json:"name,omitempty"`
+	Kind           string             `json:"kind,omitempty"`
+	Timestamp      int64              `json:"timestamp"`
+	Duration       int64              `json:"duration"`
+	LocalEndpoint  *zipkinEndpoint    `json:"localEndpoint,omitempty"`
+	RemoteEndpoint *zipkinEndpoint    `json:"remoteEndpoint,omitempty"`
+	Annotations    []zipkinAnnotation `json:"annotations,omitempty"`
+	Tags           map[string]string  `json:"tags,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	IPv4        string `json:"ipv4,omitempty"`
+	IPv6        string `json:"ipv6,omitempty"`
+	Port        int    `json:"port,omitempty"`
+}
+
+type zipkinAnnotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+// ZipkinRecorder exports finished spans in batches as Zipkin v2 JSON to a
+// Zipkin compatible collector.
+type ZipkinRecorder struct {
+	exporter *exporterS
+}
+
+// NewZipkinRecorder returns a recorder posting spans to the Zipkin v2 API
+// at url, usually http://<collector>:9411/api/v2/spans.
+func NewZipkinRecorder(url string) *ZipkinRecorder {
+	return &ZipkinRecorder{exporter: newExporter(url, encodeZipkinSpans)}
+}
+
+// RecordSpan queues the span for export.
+func (r *ZipkinRecorder) RecordSpan(span *spanS) {
+	serviceName := filepath.Base(os.Args[0])
+	if sensor != nil {
+		serviceName = sensor.serviceName
+	}
+
+	r.exporter.add(newZipkinSpan(span, serviceName))
+}
+
+// Close exports the queued spans and stops the recorder.
+func (r *ZipkinRecorder) Close() {
+	r.exporter.close()
+}
+
+func encodeZipkinSpans(batch []interface{}) interface{} {
+	spans := make([]zipkinSpan, len(batch))
+	for i, span := range batch {
+		spans[i] = span.(zipkinSpan)
+	}
+
+	return spans
+}
+
+func newZipkinSpan(span *spanS, serviceName string) zipkinSpan {
+	ret := zipkinSpan{
+		TraceID:       zipkinID(span.context.TraceID),
+		ID:            zipkinID(span.context.SpanID),
+		Name:          span.Operation,
+		Kind:          zipkinSpanKind(span),
+		Timestamp:     zipkinTime(span.Start),
+		Duration:      int64(span.Duration / time.Microsecond),
+		LocalEndpoint: &zipkinEndpoint{ServiceName: serviceName}}
+
+	if span.ParentSpanID != 0 {
+		ret.ParentID = zipkinID(span.ParentSpanID)
+	}
+
+	// Zipkin drops the duration of zero, a span took at least a microsecond
+	if ret.Duration < 1 {
+		ret.Duration = 1
+	}
+
+	ret.RemoteEndpoint = zipkinRemoteEndpoint(span)
+
+	if len(span.Tags) > 0 || span.Error {
+		ret.Tags = make(map[string]string, len(span.Tags)+1)
+		for k, v := range span.Tags {
+			ret.Tags[k] = fmt.Sprint(v)
+		}
+
+		if _, ok := ret.Tags["error"]; !ok && span.Error {
+			ret.Tags["error"] = "true"
+		}
+	}
+
+	for _, l := range span.Logs {
+		ret.Annotations = append(ret.Annotations, newZipkinAnnotation(l))
+	}
+
+	return ret
+}
+
+// zipkinRemoteEndpoint describes the other side of the span, if the peer
+// tags tell anything about it.
+func zipkinRemoteEndpoint(span *spanS) *zipkinEndpoint {
+	e := &zipkinEndpoint{ServiceName: span.getStringTag(string(ext.PeerService))}
+
+	if host := span.getStringTag(string(ext.PeerHostname)); host != "" {
+		if ip := net.ParseIP(host); ip == nil {
+			if e.ServiceName == "" {
+				e.ServiceName = host
+			}
+		} else if ip.To4() != nil {
+			e.IPv4 = host
+		} else {
+			e.IPv6 = host
+		}
+	}
+
+	if ipv4 := span.getStringTag(string(ext.PeerHostIPv4)); ipv4 != "" && e.IPv4 == "" {
+		e.IPv4 = ipv4
+	}
+
+	if ipv6 := span.getStringTag(string(ext.PeerHostIPv6)); ipv6 != "" && e.IPv6 == "" {
+		e.IPv6 = ipv6
+	}
+
+	if port := span.getIntTag(string(ext.PeerPort)); port > 0 {
+		e.Port = port
+	} else if port, ok := span.Tags[string(ext.PeerPort)].(uint16); ok {
+		e.Port = int(port)
+	}
+
+	if *e == (zipkinEndpoint{}) {
+		return nil
+	}
+
+	return e
+}
+
+// newZipkinAnnotation turns a span log into an annotation, valued by its
+// event field or by all of its fields otherwise.
+func newZipkinAnnotation(l ot.LogRecord) zipkinAnnotation {
+	a := zipkinAnnotation{Timestamp: zipkinTime(l.Timestamp)}
+
+	var fields []string
+	for _, f := range l.Fields {
+		if f.Key() == "event" && len(l.Fields) == 1 {
+			a.Value = fmt.Sprint(f.Value())
+			return a
+		}
+
+		fields = append(fields, f.Key()+"="+fmt.Sprint(f.Value()))
+	}
+	sort.Strings(fields)
+	a.Value = strings.Join(fields, " ")
+
+	return a
+}
+
+func zipkinID(id int64) string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+func zipkinTime(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+func zipkinSpanKind(span *spanS) string {
+	switch span.getStringTag(string(ext.SpanKind)) {
+	case string(ext.SpanKindProducerEnum):
+		return "PRODUCER"
+	case string(ext.SpanKindConsumerEnum):
+		return "CONSUMER"
+	}
+
+	switch span.getSpanKind() {
+	case "entry":
+		return "SERVER"
+	case "exit":
+		return "CLIENT"
+	}
+
+	return ""
+}
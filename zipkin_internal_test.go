@@ -0,0 +1,93 @@
+package instana
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZipkinRemoteEndpoint(t *testing.T) {
+	tests := []struct {
+		tags     ot.Tags
+		endpoint *zipkinEndpoint
+	}{
+		{ot.Tags{}, nil},
+		{ot.Tags{"peer.hostname": "db.local"}, &zipkinEndpoint{ServiceName: "db.local"}},
+		{ot.Tags{"peer.hostname": "db.local", "peer.service": "orders-db"}, &zipkinEndpoint{ServiceName: "orders-db"}},
+		{ot.Tags{"peer.hostname": "10.0.0.1", "peer.port": uint16(5432)}, &zipkinEndpoint{IPv4: "10.0.0.1", Port: 5432}},
+		{ot.Tags{"peer.hostname": "::1", "peer.port": 8080}, &zipkinEndpoint{IPv6: "::1", Port: 8080}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.endpoint, zipkinRemoteEndpoint(&spanS{Tags: test.tags}), "%v", test.tags)
+	}
+}
+
+func TestZipkinRecorder(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]zipkinSpan
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var spans []zipkinSpan
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&spans))
+
+		mu.Lock()
+		batches = append(batches, spans)
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	opts := Options{LogLevel: Debug}
+	recorder := NewZipkinRecorder(srv.URL + "/api/v2/spans")
+	tracer := NewTracerWithEverything(&opts, recorder)
+
+	start := time.Now()
+	parent := tracer.StartSpan("get /orders", ot.StartTime(start))
+	parent.SetTag(string(ext.SpanKind), "entry")
+
+	child := tracer.StartSpan("select", ot.ChildOf(parent.Context()))
+	ext.SpanKindRPCClient.Set(child)
+	ext.PeerHostname.Set(child, "db.local")
+	child.LogFields(otlog.String("event", "connected"))
+	child.LogFields(otlog.String("retry", "1"), otlog.Int("attempt", 2))
+	child.SetTag("error", true)
+	child.Finish()
+	parent.FinishWithOptions(ot.FinishOptions{FinishTime: start.Add(1500 * time.Microsecond)})
+
+	recorder.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !assert.Equal(t, 1, len(batches)) || !assert.Equal(t, 2, len(batches[0])) {
+		return
+	}
+	c, p := batches[0][0], batches[0][1]
+
+	assert.Equal(t, "get /orders", p.Name)
+	assert.Equal(t, "SERVER", p.Kind)
+	assert.Equal(t, "", p.ParentID)
+	assert.Equal(t, start.UnixNano()/1000, p.Timestamp, "Timestamps should be in microseconds")
+	assert.Equal(t, int64(1500), p.Duration, "Durations should be in microseconds")
+	assert.Equal(t, &zipkinEndpoint{ServiceName: sensor.serviceName}, p.LocalEndpoint)
+	assert.Nil(t, p.RemoteEndpoint)
+
+	assert.Equal(t, "CLIENT", c.Kind)
+	assert.Equal(t, p.TraceID, c.TraceID)
+	assert.Equal(t, p.ID, c.ParentID)
+	assert.Equal(t, 16, len(c.ID))
+	assert.Equal(t, &zipkinEndpoint{ServiceName: "db.local"}, c.RemoteEndpoint)
+	assert.Equal(t, "true", c.Tags["error"])
+	if assert.Equal(t, 2, len(c.Annotations)) {
+		assert.Equal(t, "connected", c.Annotations[0].Value)
+		assert.Equal(t, "attempt=2 retry=1", c.Annotations[1].Value)
+	}
+}